@@ -2,13 +2,25 @@ package main
 
 import (
 	"LAN_Transfer/service"
+	"flag"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path of the config file (default: config.json in the user config directory)")
+	flag.Parse()
 	service.InitWidget()
 	service.Log("Init Widget Success")
+	service.LoadConfig(*configPath)
+	service.InitLogFile()
+	service.InitSettingTab()
+	service.LoadHistory()
 	service.Receiver.InitSetting()
 	service.Sender.InitSetting()
+	service.InitHotFolderTab()
+	service.InitAccessTab()
+	service.InitTray()
+	service.LoadSchedule()
+	service.RunScheduler()
 	service.Sender.RunIpSearcher()
 	service.MainWindow.ShowAndRun()
 }
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 接收端的访问控制方式
+const (
+	AccessAllowAll  = "Allow all except blocked"
+	AccessAllowList = "Only allowed senders"
+)
+
+// 访问规则的类型，目前只有按ip或网段匹配
+const (
+	RuleIP = "ip"
+)
+
+// AccessRule 一条访问规则，Pattern为ip或CIDR网段
+type AccessRule struct {
+	Kind    string    `json:"kind"`
+	Pattern string    `json:"pattern"`
+	Note    string    `json:"note,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// AccessControl 接收端的访问控制列表，被阻止的规则优先于允许的规则
+type AccessControl struct {
+	Mode  string       `json:"mode"`
+	Allow []AccessRule `json:"allow"`
+	Block []AccessRule `json:"block"`
+}
+
+var Access = AccessControl{Mode: AccessAllowAll}
+var accessLock sync.Mutex
+
+// Text 列表中显示的文本
+func (r AccessRule) Text() string {
+	text := r.Pattern
+	if r.Note != "" {
+		text += " (" + r.Note + ")"
+	}
+	return text + " " + r.Created.Format("2006-01-02 15:04:05")
+}
+
+// Match ip是否匹配规则
+func (r AccessRule) Match(ip net.IP) bool {
+	if r.Kind != RuleIP || ip == nil {
+		return false
+	}
+	if strings.Contains(r.Pattern, "/") {
+		_, network, err := net.ParseCIDR(r.Pattern)
+		return err == nil && network.Contains(ip)
+	}
+	rule := net.ParseIP(r.Pattern)
+	return rule != nil && rule.Equal(ip)
+}
+
+// ParseAccessRule 解析ip或CIDR网段
+func ParseAccessRule(pattern, note string) (AccessRule, error) {
+	pattern = strings.TrimSpace(pattern)
+	rule := AccessRule{Kind: RuleIP, Pattern: pattern, Note: note, Created: time.Now()}
+	if strings.Contains(pattern, "/") {
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return rule, errors.New("illegal network:" + pattern)
+		}
+		rule.Pattern = network.String()
+		return rule, nil
+	}
+	ip := net.ParseIP(pattern)
+	if ip == nil {
+		return rule, errors.New("illegal ip:" + pattern)
+	}
+	rule.Pattern = ip.String()
+	return rule, nil
+}
+
+func accessPath() (string, error) {
+	return ConfigFile("access.json")
+}
+
+// LoadAccess 读取访问控制列表
+func LoadAccess() {
+	path, err := accessPath()
+	if err != nil {
+		LogErr("Load access list error:" + err.Error())
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			LogErr("Load access list error:" + err.Error())
+		}
+		return
+	}
+	accessLock.Lock()
+	err = json.Unmarshal(data, &Access)
+	if Access.Mode != AccessAllowList {
+		Access.Mode = AccessAllowAll
+	}
+	accessLock.Unlock()
+	if err != nil {
+		LogErr("Load access list error:" + err.Error())
+		return
+	}
+	Log("Load access list", F("mode", Access.Mode), F("allow", len(Access.Allow)), F("block", len(Access.Block)))
+	RefreshAccessList()
+}
+
+// saveAccess 保存访问控制列表，调用时需持有accessLock
+func saveAccess() {
+	path, err := accessPath()
+	if err != nil {
+		LogErr("Save access list error:" + err.Error())
+		return
+	}
+	data, err := json.MarshalIndent(Access, "", "  ")
+	if err != nil {
+		LogErr("Save access list error:" + err.Error())
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		LogErr("Save access list error:" + err.Error())
+		return
+	}
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		LogErr("Save access list error:" + err.Error())
+	}
+}
+
+// SetAccessMode 设置访问控制方式
+func SetAccessMode(mode string) {
+	accessLock.Lock()
+	Access.Mode = mode
+	saveAccess()
+	accessLock.Unlock()
+	Log("Set access mode", F("mode", mode))
+}
+
+// AddAccessRule 新增允许或阻止的规则，同一网段已存在时只更新备注
+func AddAccessRule(pattern, note string, block bool) error {
+	rule, err := ParseAccessRule(pattern, note)
+	if err != nil {
+		return err
+	}
+	accessLock.Lock()
+	rules := &Access.Allow
+	if block {
+		rules = &Access.Block
+	}
+	exists := false
+	for i := range *rules {
+		if (*rules)[i].Pattern == rule.Pattern {
+			(*rules)[i].Note = rule.Note
+			exists = true
+		}
+	}
+	if !exists {
+		*rules = append(*rules, rule)
+	}
+	saveAccess()
+	accessLock.Unlock()
+	Log("Add access rule", F("pattern", rule.Pattern), F("block", block))
+	RefreshAccessList()
+	return nil
+}
+
+// RemoveAccessRule 删除规则
+func RemoveAccessRule(pattern string, block bool) {
+	accessLock.Lock()
+	rules := &Access.Allow
+	if block {
+		rules = &Access.Block
+	}
+	for i, rule := range *rules {
+		if rule.Pattern == pattern {
+			*rules = append((*rules)[:i], (*rules)[i+1:]...)
+			break
+		}
+	}
+	saveAccess()
+	accessLock.Unlock()
+	Log("Remove access rule", F("pattern", pattern), F("block", block))
+	RefreshAccessList()
+}
+
+// AccessAllowed 按访问控制列表判断是否接受该地址(host:port)的连接，返回false时同时返回原因
+func AccessAllowed(address string) (bool, string) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := parseZonedIP(host)
+	accessLock.Lock()
+	defer accessLock.Unlock()
+	for _, rule := range Access.Block {
+		if rule.Match(ip) {
+			return false, "blocked by " + rule.Pattern
+		}
+	}
+	if Access.Mode != AccessAllowList {
+		return true, ""
+	}
+	for _, rule := range Access.Allow {
+		if rule.Match(ip) {
+			return true, ""
+		}
+	}
+	return false, "not in allow list"
+}
+
+// SenderIP 从传输或记录中的对端文本提取ip，如192.168.1.2:5000、device(192.168.1.2)
+func SenderIP(peer string) (string, bool) {
+	if i := strings.LastIndex(peer, "("); i >= 0 && strings.HasSuffix(peer, ")") {
+		peer = peer[i+1 : len(peer)-1]
+	}
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	ip := parseZonedIP(peer)
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// parseZonedIP 解析ip，去掉链路本地ipv6地址的区域，如fe80::1%eth0
+func parseZonedIP(host string) net.IP {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// BlockSender 阻止该发送端并取消它正在进行的接收
+func BlockSender(peer, note string) error {
+	ip, ok := SenderIP(peer)
+	if !ok {
+		return errors.New("unable to find the sender ip:" + peer)
+	}
+	if err := AddAccessRule(ip, note, true); err != nil {
+		return err
+	}
+	canceled := 0
+	ActiveTransfers.Range(func(key TransferKey, value *Transfer) bool {
+		if value.Direction == DirectionReceived {
+			if other, ok := SenderIP(value.Peer); ok && other == ip {
+				value.Cancel()
+				canceled++
+			}
+		}
+		return true
+	})
+	LogWarn("Block sender", FPeer(ip), F("canceled", canceled))
+	return nil
+}
+
+// AccessItem 访问页列表中的一条规则
+type AccessItem struct {
+	Rule  AccessRule
+	Block bool
+}
+
+// Text 列表中显示的文本
+func (i AccessItem) Text() string {
+	if i.Block {
+		return "Blocked " + i.Rule.Text()
+	}
+	return "Allowed " + i.Rule.Text()
+}
+
+// ListAccessRules 先列出阻止的规则，再列出允许的规则
+func ListAccessRules() []AccessItem {
+	accessLock.Lock()
+	defer accessLock.Unlock()
+	items := make([]AccessItem, 0, len(Access.Block)+len(Access.Allow))
+	for _, rule := range Access.Block {
+		items = append(items, AccessItem{Rule: rule, Block: true})
+	}
+	for _, rule := range Access.Allow {
+		items = append(items, AccessItem{Rule: rule})
+	}
+	return items
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessRuleMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, ip string
+		want        bool
+	}{
+		{"192.168.1.5", "192.168.1.5", true},
+		{"192.168.1.5", "192.168.1.6", false},
+		{"192.168.1.0/24", "192.168.1.200", true},
+		{"192.168.1.0/24", "192.168.2.1", false},
+		{"10.0.0.0/8", "10.255.0.1", true},
+		{"192.168.1.5", "::ffff:192.168.1.5", true},
+		{"192.168.1.0/24", "::ffff:192.168.1.9", true},
+		{"::ffff:192.168.1.5", "192.168.1.5", true},
+		{"fe80::/10", "fe80::1", true},
+		{"fe80::/10", "192.168.1.5", false},
+		{"fe80::1", "fe80::1", true},
+	} {
+		rule, err := ParseAccessRule(c.pattern, "")
+		if err != nil {
+			t.Fatalf("ParseAccessRule(%q): %v", c.pattern, err)
+		}
+		if got := rule.Match(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("rule %s match %s = %v, want %v", c.pattern, c.ip, got, c.want)
+		}
+	}
+}
+
+func TestParseAccessRule(t *testing.T) {
+	for pattern, want := range map[string]string{
+		" 192.168.1.5 ":   "192.168.1.5",
+		"192.168.1.77/24": "192.168.1.0/24",
+		"FE80::1":         "fe80::1",
+		"":                "",
+		"192.168.1":       "",
+		"192.168.1.0/33":  "",
+		"pc.local":        "",
+	} {
+		rule, err := ParseAccessRule(pattern, "")
+		if want == "" {
+			if err == nil {
+				t.Errorf("ParseAccessRule(%q) = %s, want error", pattern, rule.Pattern)
+			}
+			continue
+		}
+		if err != nil || rule.Pattern != want {
+			t.Errorf("ParseAccessRule(%q) = %s %v, want %s", pattern, rule.Pattern, err, want)
+		}
+	}
+}
+
+func TestAccessAllowed(t *testing.T) {
+	saved := Access
+	defer func() { Access = saved }()
+	rule := func(pattern string) AccessRule {
+		r, err := ParseAccessRule(pattern, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	for _, c := range []struct {
+		name    string
+		access  AccessControl
+		address string
+		want    bool
+	}{
+		{"allow all", AccessControl{Mode: AccessAllowAll}, "192.168.1.5:5000", true},
+		{"blocked", AccessControl{Mode: AccessAllowAll, Block: []AccessRule{rule("192.168.1.5")}}, "192.168.1.5:5000", false},
+		{"blocked v4 in v6", AccessControl{Mode: AccessAllowAll, Block: []AccessRule{rule("192.168.1.0/24")}}, "[::ffff:192.168.1.5]:5000", false},
+		{"other ip", AccessControl{Mode: AccessAllowAll, Block: []AccessRule{rule("192.168.1.5")}}, "192.168.1.6:5000", true},
+		{"empty allow list", AccessControl{Mode: AccessAllowList}, "192.168.1.5:5000", false},
+		{"allowed", AccessControl{Mode: AccessAllowList, Allow: []AccessRule{rule("192.168.1.0/24")}}, "192.168.1.5:5000", true},
+		{"not allowed", AccessControl{Mode: AccessAllowList, Allow: []AccessRule{rule("192.168.1.0/24")}}, "192.168.2.5:5000", false},
+		{"allowed ipv6 with zone", AccessControl{Mode: AccessAllowList, Allow: []AccessRule{rule("fe80::/10")}}, "[fe80::1%eth0]:5000", true},
+		{"block before allow", AccessControl{Mode: AccessAllowList, Allow: []AccessRule{rule("192.168.1.0/24")}, Block: []AccessRule{rule("192.168.1.5")}}, "192.168.1.5:5000", false},
+		{"block before allow all", AccessControl{Mode: AccessAllowAll, Allow: []AccessRule{rule("192.168.1.5")}, Block: []AccessRule{rule("192.168.1.0/24")}}, "192.168.1.5:5000", false},
+		{"bare ip", AccessControl{Mode: AccessAllowList, Allow: []AccessRule{rule("192.168.1.5")}}, "192.168.1.5", true},
+		{"unparsable address", AccessControl{Mode: AccessAllowList, Allow: []AccessRule{rule("0.0.0.0/0")}}, "pc.local:5000", false},
+	} {
+		Access = c.access
+		if got, reason := AccessAllowed(c.address); got != c.want {
+			t.Errorf("%s: AccessAllowed(%s) = %v %q, want %v", c.name, c.address, got, reason, c.want)
+		}
+	}
+}
+
+func TestSenderIP(t *testing.T) {
+	for peer, want := range map[string]string{
+		"192.168.1.2:5000":     "192.168.1.2",
+		"pc(192.168.1.2:5000)": "192.168.1.2",
+		"pc(192.168.1.2)":      "192.168.1.2",
+		"[fe80::1%eth0]:5000":  "fe80::1",
+		"Browser":              "",
+	} {
+		got, ok := SenderIP(peer)
+		if got != want || ok != (want != "") {
+			t.Errorf("SenderIP(%q) = %q %v, want %q", peer, got, ok, want)
+		}
+	}
+}
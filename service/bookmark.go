@@ -0,0 +1,139 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Peer 发送目标，来源于局域网发现或手动保存的书签
+type Peer struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Token    string `json:"token,omitempty"`
+	Bookmark bool   `json:"-"`
+}
+
+// Address host:port形式的地址
+func (p Peer) Address() string {
+	return net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port)))
+}
+
+// String 列表中显示的文本
+func (p Peer) String() string {
+	if p.Name != "" {
+		return p.Name + " (" + p.Address() + ")"
+	}
+	return p.Address()
+}
+
+var Bookmarks []Peer
+
+func bookmarkPath() (string, error) {
+	return ConfigFile("bookmarks.json")
+}
+
+// LoadBookmarks 读取书签并显示到发送端列表
+func LoadBookmarks() {
+	path, err := bookmarkPath()
+	if err != nil {
+		LogErr("Load bookmarks error:" + err.Error())
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			LogErr("Load bookmarks error:" + err.Error())
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &Bookmarks); err != nil {
+		LogErr("Load bookmarks error:" + err.Error())
+		return
+	}
+	for i := range Bookmarks {
+		Bookmarks[i].Bookmark = true
+		AddSList(Bookmarks[i])
+	}
+	Log("Load bookmarks:" + strconv.Itoa(len(Bookmarks)))
+}
+
+// SaveBookmarks 保存书签
+func SaveBookmarks() error {
+	path, err := bookmarkPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(Bookmarks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// FindBookmark 按地址查找书签
+func FindBookmark(host string, port uint16) (int, bool) {
+	for i, bookmark := range Bookmarks {
+		if bookmark.Host == host && bookmark.Port == port {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// AddBookmark 新增或覆盖同地址的书签
+func AddBookmark(peer Peer) error {
+	if peer.Name == "" {
+		return errors.New("bookmark name is empty")
+	}
+	if err := HostCheck(peer.Host); err != nil {
+		return err
+	}
+	peer.Bookmark = true
+	if i, ok := FindBookmark(peer.Host, peer.Port); ok {
+		Bookmarks[i] = peer
+	} else {
+		Bookmarks = append(Bookmarks, peer)
+	}
+	RemoveSList(peer.Host, peer.Port)
+	AddSList(peer)
+	return SaveBookmarks()
+}
+
+// RemoveBookmark 删除书签
+func RemoveBookmark(host string, port uint16) error {
+	i, ok := FindBookmark(host, port)
+	if !ok {
+		return errors.New("bookmark not found")
+	}
+	Bookmarks = append(Bookmarks[:i], Bookmarks[i+1:]...)
+	RemoveSList(host, port)
+	return SaveBookmarks()
+}
+
+// ParseTarget 解析书签名称或host:port形式的目标，地址与书签相同时使用书签(包含配对码)
+func ParseTarget(target string) (Peer, error) {
+	for _, bookmark := range Bookmarks {
+		if bookmark.Name == target {
+			return bookmark, nil
+		}
+	}
+	host, portS, err := net.SplitHostPort(target)
+	if err != nil {
+		return Peer{}, err
+	}
+	if err = HostCheck(host); err != nil {
+		return Peer{}, err
+	}
+	port, err := PortCheck(portS)
+	if err != nil {
+		return Peer{}, err
+	}
+	if i, ok := FindBookmark(host, port); ok {
+		return Bookmarks[i], nil
+	}
+	return Peer{Host: host, Port: port}, nil
+}
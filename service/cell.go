@@ -1,7 +1,6 @@
 package service
 
 import (
-	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/canvas"
@@ -9,6 +8,12 @@ import (
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
 	"image/color"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,21 +34,94 @@ var (
 	RList      *widget.List
 	RListItems []string
 	SList      *widget.List
-	SListItems []string
+	SListItems []Peer
+	// SListChecked 勾选的发送目标，按地址记录
+	SListChecked = map[string]bool{}
 
 	SenderFileSelectBtn   *widget.Button
+	SListRefreshBtn       *widget.Button
+	SListBookmarkBtn      *widget.Button
 	StopSendFileBtn       *widget.Button
 	SendFileBtn           *widget.Button
+	PublishFileBtn        *widget.Button
+	MirrorFolderBtn       *widget.Button
+	ScheduleSendBtn       *widget.Button
+	SenderTextInput       *widget.Entry
+	SendTextBtn           *widget.Button
+	SendClipboardBtn      *widget.Button
 	ReceiverFileSelectBtn *widget.Button
 	ReceiverSwitch        *widget.RadioGroup
+	ReceiverAnnounceCheck *widget.Check
+	ReceiverWebCheck      *widget.Check
+	ReceiverWebUrl        *widget.Label
+	ReceiverPairingBtn    *widget.Button
+
+	DeviceNameInput      *widget.Entry
+	ConflictPolicySelect *widget.Select
+	WebPortInput         *widget.Entry
+	RateLimitInput       *widget.Entry
+	TransferLimitInput   *widget.Entry
+	RetryCountInput      *widget.Entry
+	DialTimeoutInput     *widget.Entry
+	HandshakeInput       *widget.Entry
+	IdleTimeoutInput     *widget.Entry
+	FileLimitInput       *widget.Entry
+	SessionLimitInput    *widget.Entry
+
+	HotFolderInput      *widget.Entry
+	HotFolderSelectBtn  *widget.Button
+	HotFolderTarget     *widget.Entry
+	HotFolderAfter      *widget.Select
+	HotFolderWatchCheck *widget.Check
+	HotFolderDialog     *dialog.FileDialog
+
+	TransferList  *widget.List
+	TransferItems []*Transfer
+
+	MessageList  *widget.List
+	MessageItems []HistoryEntry
+
+	ShareList  *widget.List
+	ShareItems []*Share
+
+	ScheduleList  *widget.List
+	ScheduleItems []ScheduledJob
+
+	AccessModeSelect *widget.Select
+	AccessInput      *widget.Entry
+	AccessAllowBtn   *widget.Button
+	AccessBlockBtn   *widget.Button
+	AccessList       *widget.List
+	AccessItems      []AccessItem
+
+	RouteMatchSelect *widget.Select
+	RoutePattern     *widget.Entry
+	RouteFolder      *widget.Entry
+	RouteAddBtn      *widget.Button
+	RouteList        *widget.List
+
+	HookPattern *widget.Entry
+	HookCommand *widget.Entry
+	HookAddBtn  *widget.Button
+	HookList    *widget.List
+
+	HistorySearchInput  *widget.Entry
+	HistoryFilterSelect *widget.Select
+	HistoryList         *widget.List
+	HistoryItems        []HistoryEntry
 
 	SenderProgressBar   *widget.ProgressBar
 	ReceiverProgressBar *widget.ProgressBar
 	SenderSpeedText     *canvas.Text
 	ReceiverSpeedText   *canvas.Text
 
-	Logger    *widget.Label
-	LogScroll *container.Scroll
+	Logger         *widget.Label
+	LogScroll      *container.Scroll
+	LogLevelSelect *widget.Select
+
+	MirrorDeleteCheck   *widget.Check
+	MinimizeToTrayCheck *widget.Check
+	NotificationsCheck  *widget.Check
 
 	SenderFileDialog   *dialog.FileDialog
 	ReceiverFileDialog *dialog.FileDialog
@@ -60,7 +138,25 @@ func InitWidget() {
 	Logger = widget.NewLabel("")
 
 	SIpInput = widget.NewEntry()
-	SIpInput.SetPlaceHolder("Target ip address")
+	SIpInput.SetPlaceHolder("Target ip, host name or pairing code")
+	//粘贴整段配对内容或按回车时导入，逐字输入时不导入输入到一半的内容
+	lastSIp := ""
+	importPairingInput := func(s string) {
+		if !strings.HasPrefix(strings.TrimSpace(s), PairingScheme+"://") {
+			return
+		}
+		if err := ImportPairing(strings.TrimSpace(s)); err != nil {
+			LogErr("Import pairing error:" + err.Error())
+		}
+	}
+	SIpInput.OnChanged = func(s string) {
+		pasted := len(s)-len(lastSIp) > 1
+		lastSIp = s
+		if pasted {
+			importPairingInput(s)
+		}
+	}
+	SIpInput.OnSubmitted = importPairingInput
 	RIpInput = widget.NewEntry()
 	RIpInput.SetPlaceHolder("Target lan address")
 	SenderPortInput = widget.NewEntry()
@@ -88,13 +184,7 @@ func InitWidget() {
 	SList = widget.NewList(
 		func() int { return 1 },
 		func() fyne.CanvasObject {
-			button := widget.NewButton("", nil)
-			button.OnTapped = func() {
-				if SListItemEnable {
-					SIpInput.SetText(button.Text)
-				}
-			}
-			return button
+			return container.NewBorder(nil, nil, widget.NewCheck("", nil), nil, widget.NewButton("", nil))
 		},
 		func(id widget.ListItemID, object fyne.CanvasObject) {
 		})
@@ -121,17 +211,47 @@ func InitWidget() {
 	SenderFileSelectBtn = widget.NewButton("Browser", func() {
 		SenderFileDialog.Show()
 	})
+	SListRefreshBtn = widget.NewButton("Refresh", func() {
+		Sender.RefreshIpSearcher()
+	})
+	SListBookmarkBtn = widget.NewButton("Bookmark", func() {
+		ShowBookmarkDialog()
+	})
 	StopSendFileBtn = widget.NewButton("Stop Send File", func() {
 		Sender.StopSendFile()
 	})
 	SendFileBtn = widget.NewButton("Send File", func() {
 		Sender.SendFile()
 	})
+	PublishFileBtn = widget.NewButton("Publish", func() {
+		ShowPublishDialog(SenderFileSrcInput.Text)
+	})
+	MirrorFolderBtn = widget.NewButton("Mirror", func() {
+		ShowMirrorDialog()
+	})
+	ScheduleSendBtn = widget.NewButton("Schedule", func() {
+		ShowScheduleDialog()
+	})
+	SenderTextInput = widget.NewEntry()
+	SenderTextInput.SetPlaceHolder("Text to be sent")
+	SendTextBtn = widget.NewButton("Send Text", func() {
+		Sender.SendText(SenderTextInput.Text)
+	})
+	SendClipboardBtn = widget.NewButton("Send Clipboard", func() {
+		Sender.SendClipboard()
+	})
 	ReceiverFileSelectBtn = widget.NewButton("Browser", func() {
 		ReceiverFileDialog.Show()
 	})
 	ReceiverSwitch = widget.NewRadioGroup([]string{"Receive Enable", "Receive Disable"}, nil)
 	ReceiverSwitch.SetSelected("Receive Disable")
+	ReceiverAnnounceCheck = widget.NewCheck("Periodic announce", nil)
+	ReceiverWebCheck = widget.NewCheck("Web upload", nil)
+	ReceiverWebUrl = widget.NewLabel("")
+	ReceiverWebUrl.Wrapping = fyne.TextWrapBreak
+	ReceiverPairingBtn = widget.NewButton("QR Code", func() {
+		ShowPairingDialog()
+	})
 	ReceiverSwitch.OnChanged = func(s string) {
 		if s == "Receive Enable" {
 			err := Receiver.Run()
@@ -142,7 +262,316 @@ func InitWidget() {
 		} else {
 			Receiver.Stop()
 		}
+		RefreshTray()
+	}
+
+	MirrorDeleteCheck = widget.NewCheck("Allow mirror senders to delete extraneous files", nil)
+	MinimizeToTrayCheck = widget.NewCheck("Minimize to tray when closing the window (requires a system tray)", nil)
+	NotificationsCheck = widget.NewCheck("Desktop notifications", nil)
+	DeviceNameInput = widget.NewEntry()
+	DeviceNameInput.SetPlaceHolder("Name shown to other devices")
+	ConflictPolicySelect = widget.NewSelect([]string{ConflictRename, ConflictOverwrite, ConflictSkip}, nil)
+	WebPortInput = widget.NewEntry()
+	WebPortInput.SetPlaceHolder("Port of the web page")
+	RateLimitInput = widget.NewEntry()
+	RateLimitInput.SetPlaceHolder("Unlimited, e.g. 500K or 2M (bytes/s)")
+	TransferLimitInput = widget.NewEntry()
+	TransferLimitInput.SetPlaceHolder("Unlimited, e.g. 500K or 2M (bytes/s)")
+	RetryCountInput = widget.NewEntry()
+	RetryCountInput.SetPlaceHolder("Times to retry a failed send, 0 to disable")
+	DialTimeoutInput = widget.NewEntry()
+	DialTimeoutInput.SetPlaceHolder("Seconds to wait for a connection, 0 for no limit")
+	HandshakeInput = widget.NewEntry()
+	HandshakeInput.SetPlaceHolder("Seconds to wait for the transfer header, 0 for no limit")
+	IdleTimeoutInput = widget.NewEntry()
+	IdleTimeoutInput.SetPlaceHolder("Seconds without data before a transfer is aborted, 0 for no limit")
+	FileLimitInput = widget.NewEntry()
+	FileLimitInput.SetPlaceHolder("Unlimited, e.g. 500M or 2G")
+	SessionLimitInput = widget.NewEntry()
+	SessionLimitInput.SetPlaceHolder("Unlimited, total received after enabling receive")
+
+	HotFolderInput = widget.NewEntry()
+	HotFolderInput.SetPlaceHolder("Folder to watch")
+	HotFolderDialog = dialog.NewFolderOpen(func(uri fyne.ListableURI, err error) {
+		if err != nil {
+			LogErr("Hot folder dialog error" + err.Error())
+			return
+		}
+		if uri != nil {
+			HotFolderInput.SetText(uri.Path())
+		}
+	}, MainWindow)
+	HotFolderSelectBtn = widget.NewButton("Browser", func() {
+		HotFolderDialog.Show()
+	})
+	HotFolderTarget = widget.NewEntry()
+	HotFolderTarget.SetPlaceHolder("host:port or bookmark name")
+	HotFolderAfter = widget.NewSelect([]string{HotFolderKeep, HotFolderMove, HotFolderDelete}, nil)
+	HotFolderWatchCheck = widget.NewCheck("Watch", nil)
+
+	TransferList = widget.NewList(
+		func() int { return len(TransferItems) },
+		func() fyne.CanvasObject {
+			return container.NewBorder(nil, nil, nil,
+				container.NewHBox(widget.NewButton("Limit", nil), widget.NewButton("Pause", nil), widget.NewButton("Cancel", nil), widget.NewButton("Block", nil)),
+				container.NewVBox(widget.NewLabel(""), container.NewStack(widget.NewProgressBar(), widget.NewProgressBarInfinite())),
+			)
+		},
+		func(id widget.ListItemID, object fyne.CanvasObject) {
+			transfer := TransferItems[id]
+			row := object.(*fyne.Container)
+			info := row.Objects[0].(*fyne.Container)
+			info.Objects[0].(*widget.Label).SetText(transfer.Text())
+			bars := info.Objects[1].(*fyne.Container)
+			bar, infinite := bars.Objects[0].(*widget.ProgressBar), bars.Objects[1].(*widget.ProgressBarInfinite)
+			//不知道大小的浏览器上传显示滚动的进度条
+			if transfer.SizeKnown() {
+				bar.SetValue(transfer.Progress())
+				bar.Show()
+				if infinite.Visible() {
+					infinite.Hide()
+				}
+			} else {
+				bar.Hide()
+				if !infinite.Visible() {
+					infinite.Show()
+				}
+			}
+			buttons := row.Objects[1].(*fyne.Container)
+			buttons.Objects[0].(*widget.Button).OnTapped = func() {
+				ShowTransferLimitDialog(transfer)
+			}
+			pauseBtn := buttons.Objects[1].(*widget.Button)
+			if transfer.Paused() {
+				pauseBtn.SetText("Resume")
+			} else {
+				pauseBtn.SetText("Pause")
+			}
+			pauseBtn.OnTapped = func() {
+				transfer.SetPaused(!transfer.Paused())
+			}
+			buttons.Objects[2].(*widget.Button).OnTapped = func() {
+				transfer.Cancel()
+			}
+			blockBtn := buttons.Objects[3].(*widget.Button)
+			if transfer.Direction == DirectionReceived {
+				blockBtn.Enable()
+			} else {
+				blockBtn.Disable()
+			}
+			blockBtn.OnTapped = func() {
+				ShowBlockDialog(transfer.Peer, transfer.Device)
+			}
+		})
+	RunTransferMonitor()
+
+	MessageList = widget.NewList(
+		func() int { return len(MessageItems) },
+		func() fyne.CanvasObject {
+			return newMessageRow()
+		},
+		func(id widget.ListItemID, object fyne.CanvasObject) {
+			entry := MessageItems[id]
+			row := object.(*fyne.Container)
+			row.Objects[0].(*widget.Label).SetText(messageText(entry))
+			row.Objects[1].(*widget.Button).OnTapped = func() {
+				MainWindow.Clipboard().SetContent(entry.Message)
+				Log("Copy message to clipboard", FPeer(entry.Peer))
+			}
+		})
+
+	ShareList = widget.NewList(
+		func() int { return len(ShareItems) },
+		func() fyne.CanvasObject {
+			return newShareRow()
+		},
+		func(id widget.ListItemID, object fyne.CanvasObject) {
+			share := ShareItems[id]
+			row := object.(*fyne.Container)
+			urls := setShareRow(row, share)
+			buttons := row.Objects[1].(*fyne.Container)
+			buttons.Objects[0].(*widget.Button).OnTapped = func() {
+				if len(urls) > 0 {
+					MainWindow.Clipboard().SetContent(urls[0])
+					Log("Copy share url to clipboard", FFile(share.Name))
+				}
+			}
+			buttons.Objects[1].(*widget.Button).OnTapped = func() {
+				UnpublishFile(share.Token)
+			}
+		})
+
+	ScheduleList = widget.NewList(
+		func() int { return len(ScheduleItems) },
+		func() fyne.CanvasObject {
+			return container.NewBorder(nil, nil, nil,
+				container.NewHBox(widget.NewButton("Run", nil), widget.NewButton("Remove", nil)),
+				widget.NewLabel(""),
+			)
+		},
+		func(id widget.ListItemID, object fyne.CanvasObject) {
+			job := ScheduleItems[id]
+			row := object.(*fyne.Container)
+			row.Objects[0].(*widget.Label).SetText(job.Text())
+			buttons := row.Objects[1].(*fyne.Container)
+			buttons.Objects[0].(*widget.Button).OnTapped = func() {
+				RunScheduledJobNow(job.Id)
+			}
+			buttons.Objects[1].(*widget.Button).OnTapped = func() {
+				RemoveScheduledJob(job.Id)
+			}
+		})
+
+	HistorySearchInput = widget.NewEntry()
+	HistorySearchInput.SetPlaceHolder("Search peer, file name or md5")
+	HistorySearchInput.OnChanged = func(s string) {
+		RefreshHistoryList()
+	}
+	HistoryFilterSelect = widget.NewSelect([]string{"All", DirectionSent, DirectionReceived, DirectionHook, OutcomeFailed}, func(s string) {
+		RefreshHistoryList()
+	})
+	HistoryFilterSelect.SetSelected("All")
+	HistoryList = widget.NewList(
+		func() int { return len(HistoryItems) },
+		func() fyne.CanvasObject {
+			return container.NewBorder(nil, nil, nil,
+				container.NewHBox(widget.NewButton("Folder", nil), widget.NewButton("Resend", nil), widget.NewButton("Block", nil)),
+				widget.NewLabel(""),
+			)
+		},
+		func(id widget.ListItemID, object fyne.CanvasObject) {
+			entry := HistoryItems[id]
+			row := object.(*fyne.Container)
+			row.Objects[0].(*widget.Label).SetText(entry.Text())
+			buttons := row.Objects[1].(*fyne.Container)
+			folderBtn := buttons.Objects[0].(*widget.Button)
+			//失败的接收只记录了文件名，没有可以打开的文件夹
+			if _, ok := historyFolder(entry); ok {
+				folderBtn.Enable()
+			} else {
+				folderBtn.Disable()
+			}
+			folderBtn.OnTapped = func() {
+				OpenHistoryFolder(entry)
+			}
+			resendBtn := buttons.Objects[1].(*widget.Button)
+			//钩子记录的文件是接收到的文件，没有可以重发或阻止的对端
+			if entry.Direction == DirectionHook {
+				resendBtn.Disable()
+			} else {
+				resendBtn.Enable()
+			}
+			resendBtn.OnTapped = func() {
+				ResendHistory(entry)
+			}
+			blockBtn := buttons.Objects[2].(*widget.Button)
+			if entry.Direction == DirectionReceived {
+				blockBtn.Enable()
+			} else {
+				blockBtn.Disable()
+			}
+			blockBtn.OnTapped = func() {
+				ShowBlockDialog(entry.Peer, "")
+			}
+		})
+
+	AccessModeSelect = widget.NewSelect([]string{AccessAllowAll, AccessAllowList}, nil)
+	AccessInput = widget.NewEntry()
+	AccessInput.SetPlaceHolder("IP or network, e.g. 192.168.1.20 or 192.168.1.0/24")
+	addAccessRule := func(block bool) {
+		if err := AddAccessRule(AccessInput.Text, "", block); err != nil {
+			LogErr("Add access rule error:" + err.Error())
+			dialog.ShowError(err, MainWindow)
+			return
+		}
+		AccessInput.SetText("")
 	}
+	AccessAllowBtn = widget.NewButton("Allow", func() {
+		addAccessRule(false)
+	})
+	AccessBlockBtn = widget.NewButton("Block", func() {
+		addAccessRule(true)
+	})
+	AccessList = widget.NewList(
+		func() int { return len(AccessItems) },
+		func() fyne.CanvasObject {
+			return container.NewBorder(nil, nil, nil, widget.NewButton("Remove", nil), widget.NewLabel(""))
+		},
+		func(id widget.ListItemID, object fyne.CanvasObject) {
+			item := AccessItems[id]
+			row := object.(*fyne.Container)
+			row.Objects[0].(*widget.Label).SetText(item.Text())
+			row.Objects[1].(*widget.Button).OnTapped = func() {
+				RemoveAccessRule(item.Rule.Pattern, item.Block)
+			}
+		})
+
+	RouteMatchSelect = widget.NewSelect([]string{RouteName, RouteDevice, RouteAny}, nil)
+	RouteMatchSelect.SetSelected(RouteName)
+	RoutePattern = widget.NewEntry()
+	RoutePattern.SetPlaceHolder("e.g. *.jpg,*.png or *.apk or Phone*")
+	RouteFolder = widget.NewEntry()
+	RouteFolder.SetPlaceHolder("e.g. Pictures or {device}/{date}, also {ext}")
+	RouteAddBtn = widget.NewButton("Add", func() {
+		rule := RouteRule{Match: RouteMatchSelect.Selected, Pattern: RoutePattern.Text, Folder: RouteFolder.Text}
+		if err := AddRouteRule(rule); err != nil {
+			LogErr("Add route rule error:" + err.Error())
+			dialog.ShowError(err, MainWindow)
+			return
+		}
+		RoutePattern.SetText("")
+		RouteFolder.SetText("")
+	})
+	RouteList = widget.NewList(
+		func() int { return len(Setting.Routes) },
+		func() fyne.CanvasObject {
+			return container.NewBorder(nil, nil, nil,
+				container.NewHBox(widget.NewButton("Up", nil), widget.NewButton("Remove", nil)),
+				widget.NewLabel(""))
+		},
+		func(id widget.ListItemID, object fyne.CanvasObject) {
+			row := object.(*fyne.Container)
+			row.Objects[0].(*widget.Label).SetText(Setting.Routes[id].Text())
+			buttons := row.Objects[1].(*fyne.Container)
+			upBtn := buttons.Objects[0].(*widget.Button)
+			upBtn.OnTapped = func() {
+				MoveRouteRuleUp(id)
+			}
+			if id == 0 {
+				upBtn.Disable()
+			} else {
+				upBtn.Enable()
+			}
+			buttons.Objects[1].(*widget.Button).OnTapped = func() {
+				RemoveRouteRule(id)
+			}
+		})
+
+	HookPattern = widget.NewEntry()
+	HookPattern.SetPlaceHolder("e.g. *.zip, empty for all files")
+	HookCommand = widget.NewEntry()
+	HookCommand.SetPlaceHolder(`e.g. unzip -o "$LAN_TRANSFER_PATH"`)
+	HookAddBtn = widget.NewButton("Add", func() {
+		if err := AddHookRule(HookRule{Pattern: HookPattern.Text, Command: HookCommand.Text}); err != nil {
+			LogErr("Add receive hook error:" + err.Error())
+			dialog.ShowError(err, MainWindow)
+			return
+		}
+		HookPattern.SetText("")
+		HookCommand.SetText("")
+	})
+	HookList = widget.NewList(
+		func() int { return len(Setting.Hooks) },
+		func() fyne.CanvasObject {
+			return container.NewBorder(nil, nil, nil, widget.NewButton("Remove", nil), widget.NewLabel(""))
+		},
+		func(id widget.ListItemID, object fyne.CanvasObject) {
+			row := object.(*fyne.Container)
+			row.Objects[0].(*widget.Label).SetText(Setting.Hooks[id].Text())
+			row.Objects[1].(*widget.Button).OnTapped = func() {
+				RemoveHookRule(id)
+			}
+		})
 
 	SenderProgressBar = widget.NewProgressBar()
 	ReceiverProgressBar = widget.NewProgressBar()
@@ -152,20 +581,25 @@ func InitWidget() {
 	Tabs = container.NewAppTabs(
 		container.NewTabItem("Sender",
 			container.NewGridWithColumns(2,
-				container.NewGridWithRows(2,
-					SIpInput,
+				container.NewGridWithRows(3,
+					container.NewBorder(nil, nil, nil, container.NewHBox(SListRefreshBtn, SListBookmarkBtn), SIpInput),
 					SList,
+					ScheduleList,
 				),
-				container.NewGridWithRows(4,
+				container.NewGridWithRows(5,
 					container.NewGridWithColumns(2,
 						SenderPortInput,
 						SenderFileSelectBtn,
 					),
 					SenderFileSrcInput,
-					container.NewGridWithColumns(2,
+					container.NewGridWithColumns(5,
 						StopSendFileBtn,
+						PublishFileBtn,
+						MirrorFolderBtn,
+						ScheduleSendBtn,
 						SendFileBtn,
 					),
+					container.NewBorder(nil, nil, nil, container.NewHBox(SendTextBtn, SendClipboardBtn), SenderTextInput),
 					container.NewStack(SenderProgressBar, SenderSpeedText),
 				),
 			),
@@ -176,20 +610,91 @@ func InitWidget() {
 					RIpInput,
 					RList,
 				),
-				container.NewGridWithRows(4,
+				container.NewGridWithRows(5,
 					container.NewGridWithColumns(2,
 						ReceiverPortInput,
 						ReceiverFileSelectBtn,
 					),
 					ReceiverFileSrcInput,
-					ReceiverSwitch,
+					container.NewGridWithColumns(2,
+						ReceiverSwitch,
+						ReceiverAnnounceCheck,
+					),
+					container.NewBorder(nil, nil, ReceiverWebCheck, ReceiverPairingBtn, ReceiverWebUrl),
 					container.NewStack(ReceiverProgressBar, ReceiverSpeedText),
 				),
 			),
 		),
 	)
+	Tabs.Append(container.NewTabItem("Transfers", TransferList))
+	Tabs.Append(container.NewTabItem("Messages", container.New(&messageListLayout{}, MessageList)))
+	Tabs.Append(container.NewTabItem("Shares", ShareList))
+	Tabs.Append(container.NewTabItem("History",
+		container.NewBorder(
+			container.NewBorder(nil, nil, nil, HistoryFilterSelect, HistorySearchInput),
+			nil, nil, nil,
+			HistoryList,
+		),
+	))
+	Tabs.Append(container.NewTabItem("Access",
+		container.NewBorder(
+			container.NewVBox(
+				AccessModeSelect,
+				container.NewBorder(nil, nil, nil, container.NewHBox(AccessAllowBtn, AccessBlockBtn), AccessInput),
+			),
+			nil, nil, nil,
+			AccessList,
+		),
+	))
+	Tabs.Append(container.NewTabItem("Routing",
+		container.NewBorder(
+			widget.NewForm(
+				widget.NewFormItem("Match", RouteMatchSelect),
+				widget.NewFormItem("Pattern", RoutePattern),
+				widget.NewFormItem("Folder", container.NewBorder(nil, nil, nil, RouteAddBtn, RouteFolder)),
+			),
+			nil, nil, nil,
+			RouteList,
+		),
+	))
+	Tabs.Append(container.NewTabItem("Hooks",
+		container.NewBorder(
+			widget.NewForm(
+				widget.NewFormItem("Files", HookPattern),
+				widget.NewFormItem("Command", container.NewBorder(nil, nil, nil, HookAddBtn, HookCommand)),
+			),
+			nil, nil, nil,
+			HookList,
+		),
+	))
+	Tabs.Append(container.NewTabItem("Hot Folder",
+		widget.NewForm(
+			widget.NewFormItem("Folder", container.NewBorder(nil, nil, nil, HotFolderSelectBtn, HotFolderInput)),
+			widget.NewFormItem("Send to", HotFolderTarget),
+			widget.NewFormItem("After send", HotFolderAfter),
+			widget.NewFormItem("", HotFolderWatchCheck),
+		),
+	))
+	Tabs.Append(container.NewTabItem("Settings",
+		widget.NewForm(
+			widget.NewFormItem("Device name", DeviceNameInput),
+			widget.NewFormItem("File conflict", ConflictPolicySelect),
+			widget.NewFormItem("Web port", WebPortInput),
+			widget.NewFormItem("Global limit", RateLimitInput),
+			widget.NewFormItem("Per transfer limit", TransferLimitInput),
+			widget.NewFormItem("Send retries", RetryCountInput),
+			widget.NewFormItem("Dial timeout (s)", DialTimeoutInput),
+			widget.NewFormItem("Handshake timeout (s)", HandshakeInput),
+			widget.NewFormItem("Idle timeout (s)", IdleTimeoutInput),
+			widget.NewFormItem("Max file size", FileLimitInput),
+			widget.NewFormItem("Max session size", SessionLimitInput),
+			widget.NewFormItem("", MirrorDeleteCheck),
+			widget.NewFormItem("", MinimizeToTrayCheck),
+			widget.NewFormItem("", NotificationsCheck),
+		),
+	))
 	Tabs.OnSelected = func(item *container.TabItem) {
-		if item.Text == "Receiver" {
+		if item.Text != "Sender" {
 			Sender.StopIpSearcher()
 		} else {
 			err := Sender.RunIpSearcher()
@@ -200,12 +705,503 @@ func InitWidget() {
 		}
 	}
 	LogScroll = container.NewScroll(Logger)
+	LogLevelSelect = widget.NewSelect(levelNames, func(s string) {
+		LogLevel = ParseLevel(s)
+		RefreshLogger()
+	})
+	LogLevelSelect.SetSelected(LogLevel.String())
 	box := container.NewGridWithRows(2,
 		Tabs,
-		LogScroll,
+		container.NewBorder(nil, nil, nil, container.NewVBox(LogLevelSelect), LogScroll),
 	)
 	MainWindow.SetContent(box)
 }
+
+// InitSettingTab 把设置显示到设置页，修改后立即保存
+func InitSettingTab() {
+	DeviceNameInput.SetText(Setting.DeviceName)
+	DeviceNameInput.OnChanged = func(s string) {
+		Setting.DeviceName = s
+		SaveConfig()
+	}
+	ConflictPolicySelect.SetSelected(Setting.ConflictPolicy)
+	ConflictPolicySelect.OnChanged = func(s string) {
+		Setting.ConflictPolicy = s
+		SaveConfig()
+	}
+	WebPortInput.SetText(strconv.Itoa(int(Setting.WebPort)))
+	WebPortInput.Validator = func(s string) error {
+		_, err := PortCheck(s)
+		return err
+	}
+	WebPortInput.OnChanged = func(s string) {
+		if port, err := PortCheck(s); err == nil {
+			Setting.WebPort = port
+			SaveConfig()
+		}
+	}
+	rateValidator := func(s string) error {
+		_, err := ParseRate(s)
+		return err
+	}
+	GlobalLimiter.SetRate(Setting.RateLimit)
+	RateLimitInput.SetText(FormatRate(Setting.RateLimit))
+	RateLimitInput.Validator = rateValidator
+	RateLimitInput.OnChanged = func(s string) {
+		if rate, err := ParseRate(s); err == nil {
+			Setting.RateLimit = rate
+			GlobalLimiter.SetRate(rate)
+			SaveConfig()
+			RefreshTransferList()
+		}
+	}
+	TransferLimitInput.SetText(FormatRate(Setting.TransferRateLimit))
+	TransferLimitInput.Validator = rateValidator
+	TransferLimitInput.OnChanged = func(s string) {
+		if rate, err := ParseRate(s); err == nil {
+			Setting.TransferRateLimit = rate
+			SaveConfig()
+		}
+	}
+	RetryCountInput.SetText(strconv.Itoa(Setting.RetryCount))
+	RetryCountInput.Validator = func(s string) error {
+		_, err := RetryCountCheck(s)
+		return err
+	}
+	RetryCountInput.OnChanged = func(s string) {
+		if count, err := RetryCountCheck(s); err == nil {
+			Setting.RetryCount = count
+			SaveConfig()
+		}
+	}
+	timeoutValidator := func(s string) error {
+		_, err := TimeoutCheck(s)
+		return err
+	}
+	for _, item := range []struct {
+		input   *widget.Entry
+		setting *int
+	}{
+		{DialTimeoutInput, &Setting.DialTimeout},
+		{HandshakeInput, &Setting.HandshakeTimeout},
+		{IdleTimeoutInput, &Setting.IdleTimeout},
+	} {
+		setting := item.setting
+		item.input.SetText(strconv.Itoa(*setting))
+		item.input.Validator = timeoutValidator
+		item.input.OnChanged = func(s string) {
+			if seconds, err := TimeoutCheck(s); err == nil {
+				*setting = seconds
+				SaveConfig()
+			}
+		}
+	}
+	sizeValidator := func(s string) error {
+		_, err := ParseByteSize(s)
+		return err
+	}
+	for _, item := range []struct {
+		input   *widget.Entry
+		setting *int64
+	}{
+		{FileLimitInput, &Setting.ReceiveFileLimit},
+		{SessionLimitInput, &Setting.ReceiveSessionLimit},
+	} {
+		setting := item.setting
+		item.input.SetText(FormatSizeLimit(*setting))
+		item.input.Validator = sizeValidator
+		item.input.OnChanged = func(s string) {
+			if size, err := ParseByteSize(s); err == nil {
+				*setting = size
+				SaveConfig()
+			}
+		}
+	}
+	MirrorDeleteCheck.SetChecked(Setting.MirrorDelete)
+	MirrorDeleteCheck.OnChanged = func(b bool) {
+		Setting.MirrorDelete = b
+		SaveConfig()
+	}
+	MinimizeToTrayCheck.SetChecked(Setting.MinimizeToTray)
+	MinimizeToTrayCheck.OnChanged = func(b bool) {
+		Setting.MinimizeToTray = b
+		SaveConfig()
+	}
+	NotificationsCheck.SetChecked(Setting.Notifications)
+	NotificationsCheck.OnChanged = func(b bool) {
+		Setting.Notifications = b
+		SaveConfig()
+	}
+}
+
+// InitHotFolderTab 显示热文件夹设置，上次开启了监视时自动开始监视
+func InitHotFolderTab() {
+	config := Setting.HotFolder
+	HotFolderInput.SetText(config.Dir)
+	HotFolderTarget.SetText(config.Target)
+	HotFolderAfter.SetSelected(config.After)
+	HotFolderWatchCheck.SetChecked(config.Enabled)
+	HotFolderWatchCheck.OnChanged = func(b bool) {
+		SetHotFolderWatch(b)
+	}
+	if config.Enabled {
+		SetHotFolderWatch(true)
+	}
+}
+
+// SetHotFolderWatch 按界面上的设置开始或停止监视，开始失败时取消勾选
+func SetHotFolderWatch(watch bool) {
+	if !watch {
+		StopHotFolder()
+		Setting.HotFolder.Enabled = false
+		SaveConfig()
+		HotFolderInput.Enable()
+		HotFolderSelectBtn.Enable()
+		HotFolderTarget.Enable()
+		HotFolderAfter.Enable()
+		return
+	}
+	config := HotFolderConfig{
+		Enabled: true,
+		Dir:     HotFolderInput.Text,
+		Target:  HotFolderTarget.Text,
+		After:   HotFolderAfter.Selected,
+	}
+	if err := RunHotFolder(config); err != nil {
+		LogErr("Watch hot folder error:" + err.Error())
+		HotFolderWatchCheck.SetChecked(false)
+		return
+	}
+	Setting.HotFolder = config
+	SaveConfig()
+	HotFolderInput.Disable()
+	HotFolderSelectBtn.Disable()
+	HotFolderTarget.Disable()
+	HotFolderAfter.Disable()
+}
+
+// RefreshTransferList 刷新传输页
+func RefreshTransferList() {
+	if TransferList == nil {
+		return
+	}
+	TransferItems = ListTransfers()
+	TransferList.Refresh()
+}
+
+// ShowTransferLimitDialog 修改单个传输的限速
+func ShowTransferLimitDialog(transfer *Transfer) {
+	rateInput := widget.NewEntry()
+	rateInput.SetPlaceHolder("Unlimited, e.g. 500K or 2M (bytes/s)")
+	rateInput.SetText(FormatRate(transfer.limiter.Rate()))
+	rateInput.Validator = func(s string) error {
+		_, err := ParseRate(s)
+		return err
+	}
+	dialog.ShowForm("Transfer limit", "Save", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Limit", rateInput),
+	}, func(b bool) {
+		if !b {
+			return
+		}
+		rate, _ := ParseRate(rateInput.Text)
+		transfer.SetLimit(rate)
+	}, MainWindow)
+}
+
+// RefreshScheduleList 刷新定时发送列表
+func RefreshScheduleList() {
+	if ScheduleList == nil {
+		return
+	}
+	ScheduleItems = ListScheduledJobs()
+	ScheduleList.Refresh()
+}
+
+// ShowScheduleDialog 把当前文件与目标加入定时发送，可选在指定时间或接收端上线时发送
+func ShowScheduleDialog() {
+	fileInput := widget.NewEntry()
+	fileInput.SetText(SenderFileSrcInput.Text)
+	targetInput := widget.NewEntry()
+	targetInput.SetPlaceHolder("host:port or bookmark name")
+	if SIpInput.Text != "" {
+		targetInput.SetText(net.JoinHostPort(SIpInput.Text, SenderPortInput.Text))
+	}
+	targetInput.Validator = func(s string) error {
+		_, err := ParseTarget(s)
+		return err
+	}
+	timeInput := widget.NewEntry()
+	timeInput.SetText(time.Now().Add(time.Hour).Format("2006-01-02 15:04"))
+	timeInput.Validator = func(s string) error {
+		_, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		return err
+	}
+	whenSelect := widget.NewSelect([]string{"At time", "When peer online"}, func(s string) {
+		if s == "At time" {
+			timeInput.Enable()
+		} else {
+			timeInput.Disable()
+		}
+	})
+	whenSelect.SetSelected("At time")
+	dialog.ShowForm("Schedule send", "Schedule", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("File", fileInput),
+		widget.NewFormItem("Target", targetInput),
+		widget.NewFormItem("When", whenSelect),
+		widget.NewFormItem("Time", timeInput),
+	}, func(b bool) {
+		if !b {
+			return
+		}
+		at, _ := time.ParseInLocation("2006-01-02 15:04", timeInput.Text, time.Local)
+		err := AddScheduledJob(fileInput.Text, targetInput.Text, at, whenSelect.Selected != "At time")
+		if err != nil {
+			LogErr("Schedule send error:" + err.Error())
+		}
+	}, MainWindow)
+}
+
+// InitAccessTab 读取访问控制列表并显示到访问页
+func InitAccessTab() {
+	LoadAccess()
+	AccessModeSelect.SetSelected(Access.Mode)
+	AccessModeSelect.OnChanged = func(s string) {
+		SetAccessMode(s)
+	}
+	RefreshAccessList()
+}
+
+// RefreshAccessList 刷新访问页
+func RefreshAccessList() {
+	if AccessList == nil {
+		return
+	}
+	AccessItems = ListAccessRules()
+	AccessList.Refresh()
+}
+
+// RefreshRouteList 刷新路由页
+func RefreshRouteList() {
+	if RouteList == nil {
+		return
+	}
+	RouteList.Refresh()
+}
+
+// RefreshHookList 刷新钩子页
+func RefreshHookList() {
+	if HookList == nil {
+		return
+	}
+	HookList.Refresh()
+}
+
+// ShowBlockDialog 确认后阻止该发送端并取消它正在进行的接收
+func ShowBlockDialog(peer, device string) {
+	ip, ok := SenderIP(peer)
+	if !ok {
+		LogErr("Block sender error:unable to find the sender ip:" + peer)
+		return
+	}
+	message := "Block all connections from " + ip + "?"
+	if device != "" {
+		message = "Block all connections from " + device + " (" + ip + ")?"
+	}
+	dialog.ShowConfirm("Block sender", message, func(b bool) {
+		if !b {
+			return
+		}
+		if err := BlockSender(ip, device); err != nil {
+			LogErr("Block sender error:" + err.Error())
+		}
+	}, MainWindow)
+}
+
+// RefreshShareList 刷新发布页
+func RefreshShareList() {
+	if ShareList == nil {
+		return
+	}
+	ShareItems = ListShares()
+	refreshShareHeights()
+	ShareList.Refresh()
+}
+
+// newShareRow 发布页的一行，第二行起为各个地址的下载链接
+func newShareRow() *fyne.Container {
+	return container.NewBorder(nil, nil, nil,
+		container.NewHBox(widget.NewButton("Copy URL", nil), widget.NewButton("Unpublish", nil)),
+		container.NewVBox(widget.NewLabel(""), widget.NewLabel("")),
+	)
+}
+
+// setShareRow 设置一行的文本，返回下载链接
+func setShareRow(row *fyne.Container, share *Share) []string {
+	info := row.Objects[0].(*fyne.Container)
+	info.Objects[0].(*widget.Label).SetText(share.Text())
+	urls := WebUrlsOf(share.UrlPath())
+	info.Objects[1].(*widget.Label).SetText(strings.Join(urls, "\n"))
+	return urls
+}
+
+// refreshShareHeights 按下载链接的行数计算每行的高度，在发布列表变化时调用，文本不换行所以与列表宽度无关
+func refreshShareHeights() {
+	row := newShareRow()
+	for id, share := range ShareItems {
+		setShareRow(row, share)
+		ShareList.SetItemHeight(id, row.MinSize().Height)
+	}
+}
+
+// ShowPublishDialog 选择一次性链接与有效期后发布文件
+func ShowPublishDialog(path string) {
+	if stat, err := os.Stat(path); err != nil || stat.IsDir() {
+		LogErr("Publish file error:file path is not a file")
+		return
+	}
+	expireOptions := map[string]time.Duration{
+		"Never":      0,
+		"10 minutes": 10 * time.Minute,
+		"1 hour":     time.Hour,
+		"1 day":      24 * time.Hour,
+	}
+	oneTimeCheck := widget.NewCheck("", nil)
+	expireSelect := widget.NewSelect([]string{"Never", "10 minutes", "1 hour", "1 day"}, nil)
+	expireSelect.SetSelected("Never")
+	items := []*widget.FormItem{
+		widget.NewFormItem("File", widget.NewLabel(filepath.Base(path))),
+		widget.NewFormItem("One-time link", oneTimeCheck),
+		widget.NewFormItem("Expire after", expireSelect),
+	}
+	dialog.ShowForm("Publish file", "Publish", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		share, err := PublishFile(path, oneTimeCheck.Checked, expireOptions[expireSelect.Selected])
+		if err != nil {
+			LogErr("Publish file error:" + err.Error())
+			return
+		}
+		urls := WebUrlsOf(share.UrlPath())
+		if len(urls) > 0 {
+			MainWindow.Clipboard().SetContent(urls[0])
+			Log("Share url copied to clipboard:"+urls[0], FFile(share.Name))
+		}
+		Tabs.SelectIndex(4)
+	}, MainWindow)
+}
+
+// RefreshHistoryList 按搜索词与过滤条件刷新记录列表
+func RefreshHistoryList() {
+	if HistoryList == nil {
+		return
+	}
+	filter := HistoryFilterSelect.Selected
+	HistoryItems = FilterHistory(HistorySearchInput.Text, filter)
+	HistoryList.Refresh()
+	MessageItems = MessageItems[:0]
+	for _, entry := range FilterHistory("", "All") {
+		if entry.Message != "" && entry.Outcome == OutcomeSuccess {
+			MessageItems = append(MessageItems, entry)
+		}
+	}
+	refreshMessageHeights()
+	MessageList.Refresh()
+}
+
+// newMessageRow 消息列表的一行，文本按单词换行
+func newMessageRow() *fyne.Container {
+	label := widget.NewLabel("")
+	label.Wrapping = fyne.TextWrapWord
+	return container.NewBorder(nil, nil, nil, widget.NewButton("Copy", nil), label)
+}
+
+// messageText 消息列表中显示的文本
+func messageText(entry HistoryEntry) string {
+	return entry.Time.Format("2006-01-02 15:04:05") + " " + entry.Direction + " " + entry.Peer + "\n" + entry.Message
+}
+
+// refreshMessageHeights 按列表当前的宽度计算每条消息换行后的高度，在消息变化与列表宽度变化时调用
+func refreshMessageHeights() {
+	width := MessageList.Size().Width
+	row := newMessageRow()
+	label := row.Objects[0].(*widget.Label)
+	for id, entry := range MessageItems {
+		label.SetText(messageText(entry))
+		row.Resize(fyne.NewSize(width, 0))
+		MessageList.SetItemHeight(id, row.MinSize().Height)
+	}
+}
+
+// messageListLayout 消息列表占满整个区域，宽度变化时重新计算消息的高度
+type messageListLayout struct {
+	width float32
+}
+
+func (l *messageListLayout) Layout(objects []fyne.CanvasObject, size fyne.Size) {
+	objects[0].Move(fyne.NewPos(0, 0))
+	objects[0].Resize(size)
+	if size.Width != l.width {
+		l.width = size.Width
+		refreshMessageHeights()
+	}
+}
+
+func (l *messageListLayout) MinSize(objects []fyne.CanvasObject) fyne.Size {
+	return objects[0].MinSize()
+}
+
+// OpenHistoryFolder 打开记录中文件所在的文件夹
+func OpenHistoryFolder(entry HistoryEntry) {
+	if dir, ok := historyFolder(entry); ok {
+		OpenFolder(dir)
+	}
+}
+
+// historyFolder 记录中第一个文件所在的文件夹，只记录了文件名时返回false
+func historyFolder(entry HistoryEntry) (string, bool) {
+	if len(entry.Files) == 0 || !filepath.IsAbs(entry.Files[0]) {
+		return "", false
+	}
+	return filepath.Dir(entry.Files[0]), true
+}
+
+// OpenFolder 用系统文件管理器打开文件夹
+func OpenFolder(dir string) {
+	if dir == "" {
+		return
+	}
+	dir = filepath.ToSlash(dir)
+	if !strings.HasPrefix(dir, "/") {
+		dir = "/" + dir
+	}
+	if err := MainApp.OpenURL(&url.URL{Scheme: "file", Path: dir}); err != nil {
+		LogErr("Open folder error:" + err.Error())
+	}
+}
+
+// ResendHistory 把记录中的文件或文本与目标填入发送页
+func ResendHistory(entry HistoryEntry) {
+	if entry.Message != "" {
+		SenderTextInput.SetText(entry.Message)
+	} else if len(entry.Files) == 0 {
+		return
+	} else if _, err := os.Stat(entry.Files[0]); err != nil {
+		LogErr("Resend file error:" + err.Error())
+		return
+	} else {
+		SenderFileSrcInput.SetText(entry.Files[0])
+	}
+	if host, port, err := net.SplitHostPort(entry.Peer); err == nil {
+		SIpInput.SetText(host)
+		SenderPortInput.SetText(port)
+	} else {
+		SIpInput.SetText(entry.Peer)
+	}
+	Tabs.SelectIndex(0)
+}
+
 func RefreshRList(list []string) {
 	RListItems = list
 	RList.Length = func() int { return len(RListItems) }
@@ -215,34 +1211,278 @@ func RefreshRList(list []string) {
 	RList.Refresh()
 
 }
-func AddSList(ip string) bool {
+func AddSList(peer Peer) bool {
 	for _, item := range SListItems {
-		if item == ip {
+		if item.Host == peer.Host && item.Port == peer.Port {
 			return false
 		}
 	}
-	SListItems = append(SListItems, ip)
+	SListItems = append(SListItems, peer)
+	RefreshSList()
+	if SIpInput.Text == "" {
+		FillSenderTarget(SListItems[0])
+	}
+	return true
+}
+
+// RemoveSList 从发送端列表删除指定地址
+func RemoveSList(host string, port uint16) {
+	for i, item := range SListItems {
+		if item.Host == host && item.Port == port {
+			SListItems = append(SListItems[:i], SListItems[i+1:]...)
+			break
+		}
+	}
+	RefreshSList()
+}
+
+// CheckedPeers 列表中勾选的发送目标
+func CheckedPeers() []Peer {
+	peers := make([]Peer, 0)
+	for _, item := range SListItems {
+		if SListChecked[item.Address()] {
+			peers = append(peers, item)
+		}
+	}
+	return peers
+}
+
+// ShowSendSummary 显示发送给多个接收端的结果
+func ShowSendSummary(peers []Peer, errs []error) {
+	builder := strings.Builder{}
+	succeed := 0
+	for i, peer := range peers {
+		builder.WriteString(peer.String())
+		if errs[i] == nil {
+			succeed++
+			builder.WriteString(": " + OutcomeSuccess + "\n")
+		} else {
+			builder.WriteString(": " + errs[i].Error() + "\n")
+		}
+	}
+	title := "Sent to " + strconv.Itoa(succeed) + "/" + strconv.Itoa(len(peers)) + " receivers"
+	Log(title)
+	dialog.ShowInformation(title, builder.String(), MainWindow)
+}
+
+// ClearSList 清空发现列表，保留书签
+func ClearSList() {
+	items := make([]Peer, 0, len(Bookmarks))
+	for _, item := range SListItems {
+		if item.Bookmark {
+			items = append(items, item)
+		}
+	}
+	SListItems = items
+	RefreshSList()
+}
+
+func RefreshSList() {
 	SList.Length = func() int { return len(SListItems) }
 	SList.UpdateItem = func(id widget.ListItemID, object fyne.CanvasObject) {
-		object.(*widget.Button).SetText(SListItems[id])
+		peer := SListItems[id]
+		row := object.(*fyne.Container)
+		button := row.Objects[0].(*widget.Button)
+		button.SetText(peer.String())
+		button.OnTapped = func() {
+			if SListItemEnable {
+				FillSenderTarget(peer)
+			}
+		}
+		check := row.Objects[1].(*widget.Check)
+		check.OnChanged = nil
+		check.SetChecked(SListChecked[peer.Address()])
+		check.OnChanged = func(b bool) {
+			if b {
+				SListChecked[peer.Address()] = true
+			} else {
+				delete(SListChecked, peer.Address())
+			}
+		}
 	}
 	SList.Refresh()
-	if SIpInput.Text == "" {
-		SIpInput.SetText(SListItems[0])
+}
+
+// FillSenderTarget 把目标地址填入发送端输入框
+func FillSenderTarget(peer Peer) {
+	SIpInput.SetText(peer.Host)
+	SenderPortInput.SetText(strconv.Itoa(int(peer.Port)))
+}
+
+// ShowBookmarkDialog 当前目标已是书签则确认删除，否则填写名称保存为书签
+func ShowBookmarkDialog() {
+	port, err := PortCheck(SenderPortInput.Text)
+	if err != nil {
+		LogErr("Port is illegal:" + err.Error())
+		return
 	}
-	return true
+	host := SIpInput.Text
+	if i, ok := FindBookmark(host, port); ok {
+		dialog.ShowConfirm("Remove Bookmark", "Remove bookmark "+Bookmarks[i].String()+"?", func(b bool) {
+			if !b {
+				return
+			}
+			if err := RemoveBookmark(host, port); err != nil {
+				LogErr("Remove bookmark error:" + err.Error())
+			}
+		}, MainWindow)
+		return
+	}
+	nameInput := widget.NewEntry()
+	nameInput.SetPlaceHolder("Build server")
+	hostInput := widget.NewEntry()
+	hostInput.SetText(host)
+	hostInput.Validator = HostCheck
+	portInput := widget.NewEntry()
+	portInput.SetText(strconv.Itoa(int(port)))
+	portInput.Validator = func(s string) error {
+		_, err := PortCheck(s)
+		return err
+	}
+	dialog.ShowForm("Bookmark", "Save", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Name", nameInput),
+		widget.NewFormItem("Host", hostInput),
+		widget.NewFormItem("Port", portInput),
+	}, func(b bool) {
+		if !b {
+			return
+		}
+		port, _ := PortCheck(portInput.Text)
+		err := AddBookmark(Peer{Name: nameInput.Text, Host: hostInput.Text, Port: port})
+		if err != nil {
+			LogErr("Save bookmark error:" + err.Error())
+			return
+		}
+		Log("Save bookmark:" + nameInput.Text)
+	}, MainWindow)
 }
-func Log(msg string) {
-	formatMsg := fmt.Sprintf("[%s] %s\n", time.Now().Format("2006-01-02 15:04:05"), msg)
-	fmt.Print(formatMsg)
-	Logger.SetText(Logger.Text + formatMsg)
-	LogScroll.ScrollToBottom()
+
+// ShowPairingDialog 显示接收端地址、端口与配对码的二维码，供手机扫描后导入
+func ShowPairingDialog() {
+	ips, err := LanIps()
+	if err != nil || len(ips) == 0 {
+		LogErr("Error obtaining local IP address")
+		return
+	}
+	port := Setting.ReceiverPort
+	if p, err := PortCheck(ReceiverPortInput.Text); err == nil {
+		port = p
+	}
+	qrImage := canvas.NewImageFromImage(nil)
+	qrImage.FillMode = canvas.ImageFillOriginal
+	payloadLabel := widget.NewLabel("")
+	payloadLabel.Wrapping = fyne.TextWrapBreak
+	ipSelect := widget.NewSelect(ips, nil)
+	tokenCheck := widget.NewCheck("Require pairing token", nil)
+	tokenCheck.SetChecked(Setting.PairingToken != "")
+	update := func() {
+		payload := PairingPayload(ipSelect.Selected, port, Setting.DeviceName, Setting.PairingToken)
+		img, err := PairingQRCode(payload)
+		if err != nil {
+			LogErr("Generate QR code error:" + err.Error())
+			return
+		}
+		qrImage.Image = img
+		qrImage.Refresh()
+		payloadLabel.SetText(payload)
+	}
+	ipSelect.OnChanged = func(s string) {
+		update()
+	}
+	tokenCheck.OnChanged = func(b bool) {
+		if b == (Setting.PairingToken != "") {
+			return
+		}
+		if b {
+			Setting.PairingToken = NewPairingToken()
+			Log("Require pairing token")
+		} else {
+			Setting.PairingToken = ""
+			Log("Pairing token removed")
+		}
+		SaveConfig()
+		update()
+		//浏览器上传的地址中包含配对码
+		if ReceiverWebUrl.Text != "" {
+			ReceiverWebUrl.SetText(strings.Join(WebUrls(), " "))
+		}
+	}
+	ipSelect.SetSelected(ips[0])
+	copyBtn := widget.NewButton("Copy", func() {
+		MainWindow.Clipboard().SetContent(payloadLabel.Text)
+	})
+	content := container.NewVBox(
+		container.NewBorder(nil, nil, nil, tokenCheck, ipSelect),
+		container.NewCenter(qrImage),
+		container.NewBorder(nil, nil, nil, copyBtn, payloadLabel),
+	)
+	dialog.ShowCustom("Pairing", "Close", content, MainWindow)
 }
-func LogErr(msg string) {
-	formatMsg := fmt.Sprintf("[%s] [Error] %s\n", time.Now().Format("2006-01-02 15:04:05"), msg)
-	fmt.Print(formatMsg)
-	Logger.SetText(Logger.Text + formatMsg)
-	LogScroll.ScrollToBottom()
+
+// ShowMirrorDialog 选择本地文件夹与接收端的文件夹名后镜像，默认只预览
+func ShowMirrorDialog() {
+	folderInput := widget.NewEntry()
+	folderInput.SetPlaceHolder("Local folder")
+	remoteInput := widget.NewEntry()
+	remoteInput.SetPlaceHolder("Same as local folder name")
+	folderDialog := dialog.NewFolderOpen(func(uri fyne.ListableURI, err error) {
+		if err != nil {
+			LogErr("Mirror dialog error" + err.Error())
+			return
+		}
+		if uri != nil {
+			folderInput.SetText(uri.Path())
+		}
+	}, MainWindow)
+	deleteCheck := widget.NewCheck("", nil)
+	dryRunCheck := widget.NewCheck("", nil)
+	dryRunCheck.SetChecked(true)
+	dialog.ShowForm("Mirror folder", "Start", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Folder", container.NewBorder(nil, nil, nil, widget.NewButton("Browser", folderDialog.Show), folderInput)),
+		widget.NewFormItem("Remote folder", remoteInput),
+		widget.NewFormItem("Delete extraneous", deleteCheck),
+		widget.NewFormItem("Dry run", dryRunCheck),
+	}, func(b bool) {
+		if !b {
+			return
+		}
+		remote := remoteInput.Text
+		if remote == "" {
+			remote = filepath.Base(folderInput.Text)
+		}
+		Sender.MirrorFolder(folderInput.Text, remote, dryRunCheck.Checked, deleteCheck.Checked)
+	}, MainWindow)
+}
+
+// ShowMirrorResult 显示镜像到各接收端的对比结果
+func ShowMirrorResult(peers []Peer, plans []MirrorPlan, errs []error, dryRun, deleteExtra bool) {
+	builder := strings.Builder{}
+	for i, peer := range peers {
+		builder.WriteString(peer.String())
+		if errs[i] != nil {
+			builder.WriteString(": " + errs[i].Error() + "\n")
+			continue
+		}
+		builder.WriteString(": " + strconv.Itoa(len(plans[i].Need)) + " to send, " + strconv.Itoa(len(plans[i].Extra)) + " extraneous\n")
+		for _, path := range plans[i].Need {
+			builder.WriteString("  + " + path + "\n")
+		}
+		for _, path := range plans[i].Extra {
+			if deleteExtra {
+				builder.WriteString("  - " + path + "\n")
+			} else {
+				builder.WriteString("  = " + path + "\n")
+			}
+		}
+	}
+	title := "Mirror finished"
+	if dryRun {
+		title = "Mirror preview"
+	}
+	label := widget.NewLabel(builder.String())
+	scroll := container.NewScroll(label)
+	scroll.SetMinSize(fyne.NewSize(400, 300))
+	dialog.ShowCustom(title, "Close", scroll, MainWindow)
 }
 
 type SyncMap[K comparable, V any] struct {
@@ -259,6 +1499,10 @@ func (s *SyncMap[K, V]) Load(key K) (value V, ok bool) {
 	}
 	return value, ok
 }
+func (s *SyncMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	val, loaded := s.m.LoadOrStore(key, value)
+	return val.(V), loaded
+}
 func (s *SyncMap[K, V]) Delete(key K) {
 	s.m.Delete(key)
 }
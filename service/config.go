@@ -0,0 +1,181 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// 同名文件冲突处理策略
+const (
+	ConflictRename    = "Rename"
+	ConflictOverwrite = "Overwrite"
+	ConflictSkip      = "Skip"
+)
+
+// Config 持久化的设置
+type Config struct {
+	ReceiverPort   uint16          `json:"receiverPort"`
+	SenderPort     uint16          `json:"senderPort"`
+	DownloadDir    string          `json:"downloadDir"`
+	DeviceName     string          `json:"deviceName"`
+	AnnounceIp     string          `json:"announceIp"`
+	Announce       bool            `json:"announce"`
+	ConflictPolicy string          `json:"conflictPolicy"`
+	LastTarget     string          `json:"lastTarget"`
+	WebPort        uint16          `json:"webPort"`
+	WebUpload      bool            `json:"webUpload"`
+	PairingToken   string          `json:"pairingToken"`
+	HotFolder      HotFolderConfig `json:"hotFolder"`
+	// RateLimit 全局限速，TransferRateLimit 每个传输的默认限速，单位字节每秒，0为不限速
+	RateLimit         int64 `json:"rateLimit"`
+	TransferRateLimit int64 `json:"transferRateLimit"`
+	// RetryCount 发送失败后自动重试的次数，0为不重试
+	RetryCount int `json:"retryCount"`
+	// DialTimeout 连接、HandshakeTimeout 传输头握手、IdleTimeout 传输中没有数据的超时，单位秒，0为不限制
+	DialTimeout      int `json:"dialTimeout"`
+	HandshakeTimeout int `json:"handshakeTimeout"`
+	IdleTimeout      int `json:"idleTimeout"`
+	// ReceiveFileLimit 接收单个文件、ReceiveSessionLimit 每次开启接收后总共接收的最大字节数，0为不限制
+	ReceiveFileLimit    int64 `json:"receiveFileLimit"`
+	ReceiveSessionLimit int64 `json:"receiveSessionLimit"`
+	// Routes 接收文件保存到子文件夹的规则，按顺序取第一条匹配的规则
+	Routes []RouteRule `json:"routes"`
+	// Hooks 接收完成后执行的命令
+	Hooks []HookRule `json:"hooks"`
+	// MirrorDelete 是否允许发送端的文件夹镜像删除接收端多余的文件
+	MirrorDelete bool `json:"mirrorDelete"`
+	// MinimizeToTray 关闭窗口时最小化到托盘，默认关闭，没有托盘的桌面环境中隐藏窗口后无法恢复
+	// Notifications 是否发送桌面通知
+	MinimizeToTray bool `json:"minimizeToTray"`
+	Notifications  bool `json:"notifications"`
+}
+
+var Setting = DefaultConfig()
+
+// ConfigPath 当前使用的配置文件路径，为空时不保存
+var ConfigPath string
+
+// DefaultConfig 默认设置
+func DefaultConfig() Config {
+	config := Config{
+		ReceiverPort:     32000,
+		SenderPort:       32000,
+		ConflictPolicy:   ConflictRename,
+		WebPort:          32080,
+		HotFolder:        HotFolderConfig{After: HotFolderKeep},
+		RetryCount:       3,
+		Notifications:    true,
+		DialTimeout:      DefaultDialTimeout,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		IdleTimeout:      DefaultIdleTimeout,
+	}
+	if currentUser, err := user.Current(); err == nil {
+		config.DownloadDir = filepath.Join(currentUser.HomeDir, "Downloads")
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		config.DeviceName = hostname
+	}
+	return config
+}
+
+// LoadConfig 读取配置文件，path为空时使用用户配置目录下的config.json
+func LoadConfig(path string) {
+	if path == "" {
+		dir, err := AppConfigDir()
+		if err != nil {
+			LogErr("Unable to obtain config directory:" + err.Error())
+			return
+		}
+		path = filepath.Join(dir, "config.json")
+	}
+	ConfigPath = path
+	Log("Load config:" + path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			LogErr("Load config error:" + err.Error())
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &Setting); err != nil {
+		LogErr("Load config error:" + err.Error())
+		Setting = DefaultConfig()
+		return
+	}
+	switch Setting.ConflictPolicy {
+	case ConflictRename, ConflictOverwrite, ConflictSkip:
+	default:
+		Setting.ConflictPolicy = ConflictRename
+	}
+	switch Setting.HotFolder.After {
+	case HotFolderKeep, HotFolderMove, HotFolderDelete:
+	default:
+		Setting.HotFolder.After = HotFolderKeep
+	}
+	if Setting.RetryCount < 0 {
+		Setting.RetryCount = 0
+	}
+	if Setting.ReceiveFileLimit < 0 {
+		Setting.ReceiveFileLimit = 0
+	}
+	if Setting.ReceiveSessionLimit < 0 {
+		Setting.ReceiveSessionLimit = 0
+	}
+	for _, timeout := range []*int{&Setting.DialTimeout, &Setting.HandshakeTimeout, &Setting.IdleTimeout} {
+		if *timeout < 0 {
+			*timeout = 0
+		}
+	}
+	routes := Setting.Routes[:0]
+	for _, rule := range Setting.Routes {
+		if err := ValidateRouteRule(rule); err != nil {
+			LogWarn("Ignore route rule:"+err.Error(), F("rule", rule.Text()))
+			continue
+		}
+		routes = append(routes, rule)
+	}
+	Setting.Routes = routes
+	hooks := Setting.Hooks[:0]
+	for _, hook := range Setting.Hooks {
+		if err := ValidateHookRule(hook); err != nil {
+			LogWarn("Ignore receive hook:"+err.Error(), F("hook", hook.Text()))
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	Setting.Hooks = hooks
+}
+
+// SaveConfig 保存配置文件
+func SaveConfig() {
+	if ConfigPath == "" {
+		return
+	}
+	data, err := json.MarshalIndent(Setting, "", "  ")
+	if err != nil {
+		LogErr("Save config error:" + err.Error())
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(ConfigPath), 0755); err != nil {
+		LogErr("Save config error:" + err.Error())
+		return
+	}
+	if err = os.WriteFile(ConfigPath, data, 0644); err != nil {
+		LogErr("Save config error:" + err.Error())
+	}
+}
+
+// ConfigFile 与配置文件同目录的数据文件路径
+func ConfigFile(name string) (string, error) {
+	if ConfigPath != "" {
+		return filepath.Join(filepath.Dir(ConfigPath), name), nil
+	}
+	dir, err := AppConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
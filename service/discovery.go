@@ -0,0 +1,95 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+/**
+DiscoveryPort:udp 发现端口，与tcp端口相互独立
+发送端向组播地址与局域网广播地址发送查询，接收端单播回复携带tcp端口的信标
+接收端可选低频向组播地址与局域网广播地址主动通告
+*/
+
+// DiscoveryPort 固定的发现端口
+const DiscoveryPort uint16 = 31999
+
+// DiscoveryGroup 发现使用的组播地址
+const DiscoveryGroup = "239.255.31.99"
+
+const beaconMagic = "LANT"
+
+const (
+	BeaconQuery byte = iota + 1
+	BeaconAnnounce
+)
+
+// DiscoveryPortS 发现端口字符串
+func DiscoveryPortS() string {
+	return strconv.FormatUint(uint64(DiscoveryPort), 10)
+}
+
+// DiscoveryGroupAddr 发现组播地址
+func DiscoveryGroupAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(DiscoveryGroup), Port: int(DiscoveryPort)}
+}
+
+// EncodeBeacon 生成信标，通告信标携带tcp端口与设备名，查询信标端口为0
+func EncodeBeacon(kind byte, port uint16, name string) []byte {
+	nameBytes := []byte(name)
+	if len(nameBytes) > 255 {
+		nameBytes = nameBytes[:255]
+	}
+	beacon := make([]byte, len(beaconMagic)+4, len(beaconMagic)+4+len(nameBytes))
+	copy(beacon, beaconMagic)
+	beacon[len(beaconMagic)] = kind
+	binary.BigEndian.PutUint16(beacon[len(beaconMagic)+1:], port)
+	beacon[len(beaconMagic)+3] = byte(len(nameBytes))
+	return append(beacon, nameBytes...)
+}
+
+// DecodeBeacon 解析信标类型、tcp端口与设备名
+func DecodeBeacon(beacon []byte) (byte, uint16, string, error) {
+	head := len(beaconMagic) + 4
+	if len(beacon) < head || string(beacon[:len(beaconMagic)]) != beaconMagic {
+		return 0, 0, "", errors.New("beacon format error")
+	}
+	kind := beacon[len(beaconMagic)]
+	if kind != BeaconQuery && kind != BeaconAnnounce {
+		return 0, 0, "", errors.New("beacon kind error")
+	}
+	nameLen := int(beacon[head-1])
+	if len(beacon) < head+nameLen {
+		return 0, 0, "", errors.New("beacon name length error")
+	}
+	return kind, binary.BigEndian.Uint16(beacon[len(beaconMagic)+1:]), string(beacon[head : head+nameLen]), nil
+}
+
+// ListenDiscovery 监听发现端口，优先加入组播组(可与同机其他监听者共用端口)
+func ListenDiscovery() (net.PacketConn, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, DiscoveryGroupAddr())
+	if err == nil {
+		return conn, nil
+	}
+	LogErr("Join discovery group failed, fall back to broadcast only:" + err.Error())
+	return net.ListenPacket("udp4", ":"+DiscoveryPortS())
+}
+
+// SendBeacon 向组播地址与给定的广播地址发送信标
+func SendBeacon(conn net.PacketConn, beacon []byte, broadcastIps []string) {
+	if _, err := conn.WriteTo(beacon, DiscoveryGroupAddr()); err != nil {
+		LogErr("Beacon write error with " + DiscoveryGroup + " " + err.Error())
+	}
+	for _, ip := range broadcastIps {
+		addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(ip, DiscoveryPortS()))
+		if err != nil {
+			LogErr("Beacon resolve error with " + ip + " " + err.Error())
+			continue
+		}
+		if _, err = conn.WriteTo(beacon, addr); err != nil {
+			LogErr("Beacon write error with " + addr.String() + " " + err.Error())
+		}
+	}
+}
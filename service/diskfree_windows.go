@@ -0,0 +1,16 @@
+package service
+
+import "golang.org/x/sys/windows"
+
+// DiskFree 目录所在磁盘当前用户可用的字节数
+func DiskFree(dir string) (int64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err = windows.GetDiskFreeSpaceEx(path, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return int64(free), nil
+}
@@ -3,14 +3,16 @@ package service
 import (
 	"bytes"
 	"crypto/md5"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,113 +26,343 @@ func bufGet(size int64) []byte {
 	}
 }
 
-func SendFile(src string, writer io.Writer) error {
+// StatSendFile 发送前读取文件名与大小，在回复之前发给接收端
+func StatSendFile(src string) (FileHeader, error) {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return FileHeader{}, errors.New("Failed to obtain file information:" + err.Error())
+	}
+	if !stat.Mode().IsRegular() {
+		return FileHeader{}, errors.New("file path is not a file")
+	}
+	return FileHeader{Name: filepath.Base(src), Size: stat.Size()}, nil
+}
+
+// SendFile 发送文件内容与md5，fileHeader为已发给接收端的文件名与大小，offset为接收端已确认的字节数，md5仍按整个文件计算
+func SendFile(src string, writer io.Writer, fileHeader FileHeader, offset int64, transfers ...*Transfer) (FileResult, error) {
 	startTime := time.Now()
+	result := FileResult{Name: fileHeader.Name, Path: src, Size: fileHeader.Size}
 	//打开文件
 	file, err := os.Open(src)
 	if err != nil {
-		return errors.New("Fail to open file:" + err.Error())
+		return result, errors.New("Fail to open file:" + err.Error())
 	}
 	defer file.Close()
-	//发送文件名大小与文件名
-	fileNameBytes := []byte(filepath.Base(file.Name()))
-	if len(fileNameBytes) > 255 {
-		return errors.New("file name too long")
-	}
-	if _, err = writer.Write([]byte{byte(len(fileNameBytes))}); err != nil {
-		return errors.New("Wrong file name size sent:" + err.Error())
-	}
-	if _, err = writer.Write(fileNameBytes); err != nil {
-		return errors.New("Wrong file name sent:" + err.Error())
-	}
-	//发送文件大小
 	stat, err := file.Stat()
 	if err != nil {
-		return errors.New("Failed to obtain file information:" + err.Error())
+		return result, errors.New("Failed to obtain file information:" + err.Error())
 	}
-	fileSize := make([]byte, 8)
-	binary.BigEndian.PutUint64(fileSize, uint64(stat.Size()))
-	if _, err = writer.Write(fileSize); err != nil {
-		return errors.New("Wrong file name sent:" + err.Error())
+	if stat.Size() != fileHeader.Size {
+		return result, errors.New("file changed during sending")
 	}
 	//计算并发送文件内容与文件md5
 	buf := bufGet(stat.Size())
 	hash := md5.New()
-	hook := NewProgressBarHook(SenderProgressBar, SenderSpeedText, stat.Size())
+	if offset > stat.Size() {
+		return result, errors.New("resume offset is larger than file")
+	}
+	if offset > 0 {
+		//续传时先计算已发送部分的md5
+		if _, err = CopyNBuffer(hash, file, offset, buf); err != nil {
+			return result, errors.Join(errors.New("error reading file"), err)
+		}
+		Log("Resume sending file", FFile(result.Name), F("offset", offset))
+	}
+	hook := NewProgressBarHook(SenderProgressBar, SenderSpeedText, stat.Size()-offset, transfers...)
+	for _, transfer := range transfers {
+		if transfer != nil {
+			transfer.SetFile(result.Name, stat.Size())
+			transfer.SetOffset(offset)
+		}
+	}
 	multiWriter := io.MultiWriter(writer, hash, hook)
-	if _, err = io.CopyBuffer(multiWriter, file, buf); err != nil {
+	if _, err = CopyNBuffer(multiWriter, NewRateLimitedReader(file, transfers...), stat.Size()-offset, buf); err != nil {
 		hook.Close()
 		if errors.Is(err, net.ErrClosed) {
-			return err
+			return result, err
 		} else {
-			return errors.New("Error sending file:" + err.Error())
+			return result, errors.Join(errors.New("error sending file"), err)
 		}
 	}
 	fileMD5 := hash.Sum(nil)
+	result.MD5 = hex.EncodeToString(fileMD5)
 	if _, err = writer.Write(fileMD5); err != nil {
-		return errors.New("Error sending md5:" + err.Error())
+		hook.Close()
+		return result, errors.Join(errors.New("error sending md5"), err)
 	}
-	Log("Send file:" + string(fileNameBytes) + " size:" + strconv.FormatInt(stat.Size(), 10) + " totalTime:" + strconv.FormatFloat(float64(time.Now().Sub(startTime).Milliseconds()), 'f', -1, 64) + "ms md5:" + hex.EncodeToString(fileMD5))
+	Log("Send file", FFile(result.Name), FBytes(stat.Size()), F("totalTime", time.Now().Sub(startTime).String()), F("md5", result.MD5))
 	buf = nil
 	hook.Close()
-	return nil
+	return result, nil
 }
-func ReceiveFile(src string, reader io.Reader, pbHook *MultipleProgressBarHook) error {
+
+// ReceiveFile 接收文件内容，fileHeader为回复前读取的文件名与大小，partial不为空时续传该文件，连接中断时保留已接收的部分等待续传
+func ReceiveFile(src string, reader io.Reader, fileHeader FileHeader, pbHook *MultipleProgressBarHook, transfer *Transfer, partial *partialFile) (FileResult, error) {
 	startTime := time.Now()
-	var err error
-	//读取文件名大小
-	fileNameLen := make([]byte, 1)
-	if _, err = reader.Read(fileNameLen); err != nil {
-		return errors.Join(errors.New("error reading file name length"), err)
-	}
-	//读取文件名
-	fileName := make([]byte, fileNameLen[0])
-	if _, err = reader.Read(fileName); err != nil {
-		return errors.Join(errors.New("error reading file name"), err)
-	}
-	//fileName = bytes.TrimRight(fileName, "\x00")
-	//读取文件大小
-	fileSize := make([]byte, 8)
-	if _, err = reader.Read(fileSize); err != nil {
-		return errors.Join(errors.New("error reading file size"), err)
-	}
-	num := int64(binary.BigEndian.Uint64(fileSize))
+	result := FileResult{Name: fileHeader.Name, Size: fileHeader.Size}
+	num := fileHeader.Size
 	//读取文件内容
 	buf := bufGet(num)
 	hash := md5.New()
-	fPath := src + string(filepath.Separator) + string(fileName)
-	newFile, err := os.Create(fPath)
+	var newFile *os.File
+	var fPath string
+	var offset int64
+	var err error
+	if partial != nil {
+		newFile, fPath, offset, err = openPartial(partial, hash, buf)
+	} else {
+		var dir string
+		if dir, err = RouteDir(src, result.Name, transfer.Device); err != nil {
+			LogWarn("Route received file error:"+err.Error(), FFile(result.Name))
+		}
+		newFile, fPath, err = CreateSaveFile(dir, result.Name)
+	}
 	if err != nil {
-		return errors.Join(errors.New("error creating file"), err)
+		return result, errors.Join(errors.New("error creating file"), err)
 	}
 	defer newFile.Close()
-	pbHook.AddPB(num)
-	multiWriter := io.MultiWriter(newFile, hash, pbHook)
-	if n, err := CopyNBuffer(multiWriter, reader, num, buf); err != nil {
-		pbHook.RemovePb(n, num)
+	pbHook.AddPB(num-offset, transfer)
+	transfer.SetFile(result.Name, num)
+	transfer.SetOffset(offset)
+	multiWriter := io.MultiWriter(newFile, hash, pbHook, transfer)
+	if n, err := CopyNBuffer(multiWriter, NewRateLimitedReader(reader, transfer), num-offset, buf); err != nil {
+		pbHook.RemovePb(n, num-offset, transfer)
 		newFile.Close()
+		//连接中断而不是取消时保留已接收的部分
+		if !transfer.Canceled() {
+			keepPartial(transfer.Id, &partialFile{Path: fPath, Name: result.Name, Size: num, Written: offset + n})
+			return result, errors.Join(errors.New("error reading file"), err)
+		}
 		errF := os.Remove(fPath)
-		return errors.Join(errors.New("error reading file"), errF, err)
+		return result, errors.Join(errors.New("error reading file"), errF, err)
 	}
-	pbHook.RemovePb(num, num)
+	pbHook.RemovePb(num-offset, num-offset, transfer)
 	//读取并比较md5
 	hashSum := hash.Sum(nil)
-	fileMD5 := make([]byte, 16)
-	if _, err = reader.Read(fileMD5); err != nil {
+	fileMD5, err := ReadFileMD5(reader)
+	if err != nil {
 		newFile.Close()
 		errF := os.Remove(fPath)
-		return errors.Join(errors.New("error reading file md5"), errF, err)
+		return result, errors.Join(errors.New("error reading file md5"), errF, err)
 	}
 	if !bytes.Equal(fileMD5, hashSum) {
 		newFile.Close()
 		errF := os.Remove(fPath)
-		return errors.Join(errors.New("error equal file md5"), errF)
+		return result, errors.Join(errors.New("error equal file md5"), errF)
 	}
-	Log("Received file:" + string(fileName) + " size:" + strconv.FormatInt(num, 10) + " totalTime:" + strconv.FormatFloat(float64(time.Now().Sub(startTime).Milliseconds()), 'f', -1, 64) + "ms md5:" + hex.EncodeToString(fileMD5))
+	result.Path = fPath
+	result.MD5 = hex.EncodeToString(fileMD5)
+	Log("Received file", FFile(result.Name), FBytes(num), F("totalTime", time.Now().Sub(startTime).String()), F("md5", result.MD5))
 	buf = nil
+	return result, nil
+}
+
+// openPartial 打开等待续传的文件，计算已接收部分的md5并定位到末尾
+func openPartial(partial *partialFile, hash io.Writer, buf []byte) (*os.File, string, int64, error) {
+	file, err := os.OpenFile(partial.Path, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if _, err = CopyNBuffer(hash, file, partial.Written, buf); err != nil {
+		file.Close()
+		return nil, "", 0, err
+	}
+	if err = file.Truncate(partial.Written); err != nil {
+		file.Close()
+		return nil, "", 0, err
+	}
+	return file, partial.Path, partial.Written, nil
+}
+
+// FanOutQueue 每个接收端最多缓冲的数据块数
+const FanOutQueue = 4
+
+// FanOutMaxLag 已有接收端收下数据块后，其余缓冲已满的接收端最长的等待时间，超过后放弃该接收端，由重试从接收端确认的位置单独续传
+const FanOutMaxLag = 5 * time.Second
+
+// ErrFellBehind 接收端暂停或速度过慢，落后其他接收端太多
+var ErrFellBehind = errors.New("receiver fell too far behind the others")
+
+// FanOutWriter 把同一份数据写给多个接收端，每个接收端在单独的goroutine中写入连接并有有限的缓冲，
+// 单个接收端暂停或较慢时不会拖住其他接收端，落后太多或失败后跳过它，全部失败才返回错误
+type FanOutWriter struct {
+	peers []*fanOutPeer
+	//接收端取走数据块或结束时通知Write重新尝试
+	space chan struct{}
+}
+
+type fanOutPeer struct {
+	transfer *Transfer
+	conn     net.Conn
+	queue    chan []byte
+	done     chan struct{}
+	dropped  atomic.Bool
+	lock     sync.Mutex
+	err      error
+}
+
+func NewFanOutWriter() *FanOutWriter {
+	return &FanOutWriter{space: make(chan struct{}, 1)}
+}
+
+// Add 添加一个接收端，数据写入conn并计入transfer的进度
+func (r *FanOutWriter) Add(transfer *Transfer, conn net.Conn) {
+	peer := &fanOutPeer{transfer: transfer, conn: conn, queue: make(chan []byte, FanOutQueue), done: make(chan struct{})}
+	r.peers = append(r.peers, peer)
+	go r.run(peer)
+}
+
+func (r *FanOutWriter) run(peer *fanOutPeer) {
+	defer func() {
+		close(peer.done)
+		r.notify()
+	}()
+	for chunk := range peer.queue {
+		r.notify()
+		//暂停时在此等待，恢复前已被放弃的接收端不再写入
+		if err := peer.transfer.waitResume(); err != nil {
+			peer.fail(err)
+			return
+		}
+		if peer.dropped.Load() {
+			return
+		}
+		if _, err := peer.conn.Write(chunk); err != nil {
+			peer.fail(err)
+			return
+		}
+		peer.transfer.now.Add(int64(len(chunk)))
+	}
+}
+
+func (r *FanOutWriter) notify() {
+	select {
+	case r.space <- struct{}{}:
+	default:
+	}
+}
+
+func (p *fanOutPeer) fail(err error) {
+	p.lock.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.lock.Unlock()
+}
+
+func (p *fanOutPeer) Err() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// drop 放弃落后的接收端，关闭连接让正在进行的写入返回
+func (p *fanOutPeer) drop() {
+	p.fail(ErrFellBehind)
+	p.dropped.Store(true)
+	p.conn.Close()
+}
+
+// Write 数据块放入每个接收端的缓冲，最快的接收端收下后，其余接收端最多等待FanOutMaxLag
+func (r *FanOutWriter) Write(p []byte) (n int, err error) {
+	chunk := append([]byte(nil), p...)
+	pending := make([]*fanOutPeer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		if peer.Err() == nil {
+			pending = append(pending, peer)
+		}
+	}
+	accepted := 0
+	var lag <-chan time.Time
+	for len(pending) > 0 {
+		rest := pending[:0]
+		for _, peer := range pending {
+			if peer.Err() != nil {
+				continue
+			}
+			select {
+			case peer.queue <- chunk:
+				accepted++
+			default:
+				rest = append(rest, peer)
+			}
+		}
+		pending = rest
+		if len(pending) == 0 {
+			break
+		}
+		if accepted > 0 && lag == nil {
+			lag = time.After(FanOutMaxLag)
+		}
+		select {
+		case <-r.space:
+		case <-lag:
+			for _, peer := range pending {
+				LogWarn("Receiver fell behind, continue separately", FPeer(peer.transfer.Peer))
+				peer.drop()
+			}
+			pending = nil
+		}
+	}
+	if accepted == 0 {
+		for _, peer := range r.peers {
+			if err = peer.Err(); err != nil {
+				return 0, err
+			}
+		}
+		return 0, errors.New("no receiver available")
+	}
+	return len(p), nil
+}
+
+// Close 写完后调用，各接收端写完缓冲中的数据后结束
+func (r *FanOutWriter) Close() error {
+	for _, peer := range r.peers {
+		close(peer.queue)
+	}
 	return nil
 }
 
+// Wait 等待第i个接收端写完缓冲中的数据，返回它的错误
+func (r *FanOutWriter) Wait(i int) error {
+	<-r.peers[i].done
+	return r.peers[i].Err()
+}
+
+// CreateSaveFile 按同名文件冲突策略创建保存的文件，并发接收同名文件时不会互相覆盖
+func CreateSaveFile(dir, name string) (*os.File, string, error) {
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, "", errors.New("illegal file name:" + name)
+	}
+	fPath := filepath.Join(dir, name)
+	if Setting.ConflictPolicy == ConflictOverwrite {
+		file, err := os.Create(fPath)
+		return file, fPath, err
+	}
+	return createUniqueFile(dir, name, Setting.ConflictPolicy == ConflictSkip)
+}
+
+// createUniqueFile 创建不存在的文件，同名时依次尝试name(1).ext、name(2).ext，skip为true时同名直接返回错误
+func createUniqueFile(dir, name string, skip bool) (*os.File, string, error) {
+	fPath := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(fPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			return file, fPath, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, "", err
+		}
+		if skip {
+			return nil, "", errors.New("file already exists:" + name)
+		}
+		fPath = filepath.Join(dir, fmt.Sprintf("%s(%d)%s", base, i, ext))
+	}
+}
+
 func CopyNBuffer(dst io.Writer, src io.Reader, n int64, buf []byte) (written int64, err error) {
 	written, err = io.CopyBuffer(dst, io.LimitReader(src, n), buf)
 	if written == n {
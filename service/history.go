@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 传输方向
+const (
+	DirectionSent     = "Sent"
+	DirectionReceived = "Received"
+	DirectionHook     = "Hook"
+)
+
+// 传输结果
+const (
+	OutcomeSuccess = "Success"
+	OutcomeFailed  = "Failed"
+	OutcomeStopped = "Stopped"
+)
+
+// FileResult 单个文件的传输结果
+type FileResult struct {
+	Name string
+	Path string
+	Size int64
+	MD5  string
+}
+
+// HistoryEntry 一条传输记录
+type HistoryEntry struct {
+	Time       time.Time `json:"time"`
+	Direction  string    `json:"direction"`
+	Peer       string    `json:"peer"`
+	Files      []string  `json:"files"`
+	Size       int64     `json:"size"`
+	DurationMS int64     `json:"durationMs"`
+	MD5        string    `json:"md5"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	// Command 接收后钩子的命令，ExitCode与Output为它的退出状态与输出
+	Command  string `json:"command,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Output   string `json:"output,omitempty"`
+}
+
+// Text 记录在列表中显示的文本
+func (h HistoryEntry) Text() string {
+	builder := strings.Builder{}
+	builder.WriteString(h.Time.Format("2006-01-02 15:04:05"))
+	builder.WriteString(" ")
+	builder.WriteString(h.Direction)
+	builder.WriteString(" ")
+	builder.WriteString(h.Peer)
+	builder.WriteString(" ")
+	if h.Message != "" {
+		builder.WriteString(strconv.Quote(h.Message))
+	} else {
+		builder.WriteString(strings.Join(h.Files, ","))
+	}
+	if h.Command != "" {
+		builder.WriteString(" ")
+		builder.WriteString(strconv.Quote(h.Command))
+		builder.WriteString(" exit ")
+		builder.WriteString(strconv.Itoa(h.ExitCode))
+	}
+	builder.WriteString(" ")
+	builder.WriteString(FormatByteSize(h.Size, 1))
+	builder.WriteString(" ")
+	builder.WriteString(FormatSeconds(h.DurationMS / 1000))
+	builder.WriteString(" ")
+	builder.WriteString(h.Outcome)
+	if h.Error != "" {
+		builder.WriteString(":")
+		builder.WriteString(h.Error)
+	}
+	return builder.String()
+}
+
+// Match 是否符合搜索词与过滤条件
+func (h HistoryEntry) Match(keyword, filter string) bool {
+	switch filter {
+	case DirectionSent, DirectionReceived, DirectionHook:
+		if h.Direction != filter {
+			return false
+		}
+	case OutcomeFailed:
+		if h.Outcome == OutcomeSuccess {
+			return false
+		}
+	}
+	if keyword == "" {
+		return true
+	}
+	keyword = strings.ToLower(keyword)
+	return strings.Contains(strings.ToLower(h.Text()), keyword) || strings.Contains(strings.ToLower(h.MD5), keyword) ||
+		strings.Contains(strings.ToLower(h.Output), keyword)
+}
+
+var History []HistoryEntry
+var historyLock sync.Mutex
+
+func historyPath() (string, error) {
+	return ConfigFile("history.jsonl")
+}
+
+// LoadHistory 读取传输记录
+func LoadHistory() {
+	path, err := historyPath()
+	if err != nil {
+		LogErr("Load history error:" + err.Error())
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			LogErr("Load history error:" + err.Error())
+		}
+		return
+	}
+	defer file.Close()
+	historyLock.Lock()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1<<16), 1<<24)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		History = append(History, entry)
+	}
+	historyLock.Unlock()
+	if err = scanner.Err(); err != nil {
+		LogErr("Load history error:" + err.Error())
+	}
+	RefreshHistoryList()
+}
+
+// AddHistory 追加一条传输记录
+func AddHistory(entry HistoryEntry) {
+	historyLock.Lock()
+	History = append(History, entry)
+	historyLock.Unlock()
+	RefreshHistoryList()
+	path, err := historyPath()
+	if err != nil {
+		LogErr("Save history error:" + err.Error())
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		LogErr("Save history error:" + err.Error())
+		return
+	}
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		LogErr("Save history error:" + err.Error())
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		LogErr("Save history error:" + err.Error())
+	}
+}
+
+// RecordTransfer 根据传输结果追加记录
+func RecordTransfer(direction, peer string, result FileResult, startTime time.Time, err error) {
+	entry := HistoryEntry{
+		Time:       startTime,
+		Direction:  direction,
+		Peer:       peer,
+		Size:       result.Size,
+		DurationMS: time.Since(startTime).Milliseconds(),
+		MD5:        result.MD5,
+		Outcome:    OutcomeSuccess,
+	}
+	if result.Path != "" {
+		entry.Files = []string{result.Path}
+	} else if result.Name != "" {
+		entry.Files = []string{result.Name}
+	}
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			entry.Outcome = OutcomeStopped
+		} else {
+			entry.Outcome = OutcomeFailed
+			entry.Error = err.Error()
+		}
+	}
+	AddHistory(entry)
+}
+
+// RecordMessage 追加一条文本消息记录
+func RecordMessage(direction, peer, text string, startTime time.Time, err error) {
+	entry := HistoryEntry{
+		Time:       startTime,
+		Direction:  direction,
+		Peer:       peer,
+		Size:       int64(len(text)),
+		DurationMS: time.Since(startTime).Milliseconds(),
+		Outcome:    OutcomeSuccess,
+		Message:    text,
+	}
+	if err != nil {
+		entry.Outcome = OutcomeFailed
+		entry.Error = err.Error()
+	}
+	AddHistory(entry)
+}
+
+// FilterHistory 按搜索词与过滤条件筛选，最新的在前
+func FilterHistory(keyword, filter string) []HistoryEntry {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	out := make([]HistoryEntry, 0)
+	for i := len(History) - 1; i >= 0; i-- {
+		if History[i].Match(keyword, filter) {
+			out = append(out, History[i])
+		}
+	}
+	return out
+}
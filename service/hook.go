@@ -0,0 +1,193 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hookLock 保护Setting.Hooks，界面修改钩子时接收完成的文件可能正在匹配
+var hookLock sync.RWMutex
+
+// HookTimeout 单个钩子命令的最长运行时间，超时后结束命令
+const HookTimeout = 10 * time.Minute
+
+// HookOutputMax 记录到日志与历史记录中的命令输出的最大字节数
+const HookOutputMax = 4096
+
+// HookRule 接收完成并通过md5校验后执行的外部命令，Pattern为逗号分隔的文件名通配符，为空时匹配所有文件
+type HookRule struct {
+	Pattern string `json:"pattern"`
+	Command string `json:"command"`
+}
+
+// Text 列表中显示的文本
+func (h HookRule) Text() string {
+	pattern := h.Pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+	return pattern + " -> " + h.Command
+}
+
+// Matches 文件名是否符合规则，通配符不区分大小写
+func (h HookRule) Matches(name string) bool {
+	if strings.TrimSpace(h.Pattern) == "" {
+		return true
+	}
+	return RouteRule{Match: RouteName, Pattern: h.Pattern}.Matches(name, "")
+}
+
+// ValidateHookRule 检查命令与通配符
+func ValidateHookRule(rule HookRule) error {
+	if strings.TrimSpace(rule.Command) == "" {
+		return errors.New("hook command is empty")
+	}
+	if strings.TrimSpace(rule.Pattern) == "" {
+		return nil
+	}
+	return ValidateRouteRule(RouteRule{Match: RouteName, Pattern: rule.Pattern, Folder: "."})
+}
+
+// hookEnv 传给钩子命令的环境变量
+func hookEnv(result FileResult, device, address string) []string {
+	return append(os.Environ(),
+		"LAN_TRANSFER_PATH="+result.Path,
+		"LAN_TRANSFER_NAME="+filepath.Base(result.Path),
+		"LAN_TRANSFER_DIR="+filepath.Dir(result.Path),
+		"LAN_TRANSFER_SENDER="+device,
+		"LAN_TRANSFER_SENDER_ADDR="+address,
+		"LAN_TRANSFER_SIZE="+strconv.FormatInt(result.Size, 10),
+		"LAN_TRANSFER_MD5="+result.MD5,
+	)
+}
+
+// RunReceiveHooks 在后台依次执行与文件匹配的钩子，调用前文件需已关闭，address为发送端的ip
+// 不阻塞接收端回复发送端，输出与退出状态记录到日志与历史记录
+func RunReceiveHooks(result FileResult, device, address string) {
+	hookLock.RLock()
+	rules := Setting.Hooks
+	hookLock.RUnlock()
+	hooks := make([]HookRule, 0)
+	for _, hook := range rules {
+		if hook.Matches(result.Name) {
+			hooks = append(hooks, hook)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	go func() {
+		for _, hook := range hooks {
+			runHook(hook, result, device, address)
+		}
+	}()
+}
+
+// runHook 执行一个钩子命令并记录结果
+func runHook(hook HookRule, result FileResult, device, address string) {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+	cmd := hookCommand(ctx, hook.Command)
+	cmd.Dir = filepath.Dir(result.Path)
+	cmd.Env = hookEnv(result, device, address)
+	output := &limitedBuffer{max: HookOutputMax}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = errors.Join(ErrTimedOut, err)
+	}
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	fields := []Field{FFile(result.Path), F("command", hook.Command), F("exit", exitCode), F("output", output.String())}
+	if err != nil {
+		LogErr("Receive hook error:"+err.Error(), fields...)
+	} else {
+		Log("Receive hook finished", fields...)
+	}
+	entry := HistoryEntry{
+		Time:       startTime,
+		Direction:  DirectionHook,
+		Peer:       address,
+		Files:      []string{result.Path},
+		Size:       result.Size,
+		DurationMS: time.Since(startTime).Milliseconds(),
+		MD5:        result.MD5,
+		Outcome:    OutcomeSuccess,
+		Command:    hook.Command,
+		ExitCode:   exitCode,
+		Output:     output.String(),
+	}
+	if err != nil {
+		entry.Outcome = OutcomeFailed
+		entry.Error = err.Error()
+	}
+	AddHistory(entry)
+}
+
+// limitedBuffer 只保留前max个字节的输出，多余的丢弃但不报错，避免命令因管道写失败而退出
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	s := strings.TrimSpace(b.buf.String())
+	if b.truncated {
+		s += "..."
+	}
+	return s
+}
+
+// AddHookRule 在最后新增钩子
+func AddHookRule(rule HookRule) error {
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+	rule.Command = strings.TrimSpace(rule.Command)
+	if err := ValidateHookRule(rule); err != nil {
+		return err
+	}
+	hookLock.Lock()
+	Setting.Hooks = append(append([]HookRule{}, Setting.Hooks...), rule)
+	hookLock.Unlock()
+	SaveConfig()
+	Log("Add receive hook", F("hook", rule.Text()))
+	RefreshHookList()
+	return nil
+}
+
+// RemoveHookRule 删除第i个钩子
+func RemoveHookRule(i int) {
+	hookLock.Lock()
+	if i < 0 || i >= len(Setting.Hooks) {
+		hookLock.Unlock()
+		return
+	}
+	rule := Setting.Hooks[i]
+	Setting.Hooks = append(append([]HookRule{}, Setting.Hooks[:i]...), Setting.Hooks[i+1:]...)
+	hookLock.Unlock()
+	SaveConfig()
+	Log("Remove receive hook", F("hook", rule.Text()))
+	RefreshHookList()
+}
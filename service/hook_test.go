@@ -0,0 +1,50 @@
+package service
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestHookRulesConcurrent 界面修改钩子时接收完成的文件同时匹配钩子，需在-race下运行
+func TestHookRulesConcurrent(t *testing.T) {
+	saved := Setting.Hooks
+	defer func() { Setting.Hooks = saved }()
+	Setting.Hooks = nil
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := AddHookRule(HookRule{Pattern: "*.none", Command: "true"}); err != nil {
+				t.Error(err)
+				return
+			}
+			RemoveHookRule(0)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		RunReceiveHooks(FileResult{Name: "a.txt", Path: "/tmp/a.txt"}, "pc", "127.0.0.1")
+	}
+	wg.Wait()
+	RemoveHookRule(0)
+	if len(Setting.Hooks) != 0 {
+		t.Errorf("hooks left: %v", Setting.Hooks)
+	}
+}
+
+func TestHookRuleMatches(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"", "a.txt", true},
+		{"  ", "a.txt", true},
+		{"*.jpg", "A.JPG", true},
+		{"*.jpg, *.png", "b.png", true},
+		{"*.jpg", "a.txt", false},
+	} {
+		if got := (HookRule{Pattern: c.pattern, Command: "true"}).Matches(c.name); got != c.want {
+			t.Errorf("pattern %q match %q = %v", c.pattern, c.name, got)
+		}
+	}
+}
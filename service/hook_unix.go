@@ -0,0 +1,13 @@
+//go:build !windows
+
+package service
+
+import (
+	"context"
+	"os/exec"
+)
+
+// hookCommand 通过sh执行钩子命令
+func hookCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
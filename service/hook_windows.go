@@ -0,0 +1,11 @@
+package service
+
+import (
+	"context"
+	"os/exec"
+)
+
+// hookCommand 通过cmd执行钩子命令
+func hookCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", command)
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 热文件夹发送成功后对原文件的处理方式
+const (
+	HotFolderKeep   = "Keep"
+	HotFolderMove   = "Move to sent"
+	HotFolderDelete = "Delete"
+)
+
+// HotFolderSentDir 发送成功后移动到的子文件夹
+const HotFolderSentDir = "sent"
+
+// HotFolderDebounce 文件最后一次变化后等待的时间，期间没有变化才认为写入完成
+const HotFolderDebounce = 3 * time.Second
+
+// HotFolderConfig 热文件夹设置
+type HotFolderConfig struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir"`
+	Target  string `json:"target"`
+	After   string `json:"after"`
+}
+
+var hotWatcher *fsnotify.Watcher
+var hotLock sync.Mutex
+var hotTimers = map[string]*time.Timer{}
+var hotQueue chan string
+
+// hotStop 停止监视时关闭，发送队列中剩余的文件不再发送
+var hotStop chan struct{}
+
+// RunHotFolder 监视文件夹，新文件写入完成后自动发送给目标
+func RunHotFolder(config HotFolderConfig) error {
+	StopHotFolder()
+	if _, err := ParseTarget(config.Target); err != nil {
+		return errors.Join(errors.New("hot folder target is illegal"), err)
+	}
+	stat, err := os.Stat(config.Dir)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return errors.New("hot folder is not a folder")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(config.Dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	queue := make(chan string, 64)
+	stop := make(chan struct{})
+	hotLock.Lock()
+	hotWatcher = watcher
+	hotQueue = queue
+	hotStop = stop
+	hotLock.Unlock()
+	go watchHotFolder(watcher)
+	go sendHotFolder(queue, stop, config)
+	Log("Watch hot folder", F("dir", config.Dir), F("target", config.Target), F("after", config.After))
+	return nil
+}
+
+// StopHotFolder 停止监视，已排队的文件不再发送，正在发送的文件发送完为止
+func StopHotFolder() {
+	hotLock.Lock()
+	defer hotLock.Unlock()
+	if hotWatcher == nil {
+		return
+	}
+	hotWatcher.Close()
+	hotWatcher = nil
+	for path, timer := range hotTimers {
+		timer.Stop()
+		delete(hotTimers, path)
+	}
+	close(hotStop)
+	hotStop = nil
+	hotQueue = nil
+	Log("Stop watching hot folder")
+}
+
+func watchHotFolder(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if ignoreHotFile(event.Name) {
+				continue
+			}
+			LogDebug("Hot folder event", FFile(event.Name), F("op", event.Op.String()))
+			debounceHotFile(event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			LogErr("Hot folder watch error:" + err.Error())
+		}
+	}
+}
+
+// ignoreHotFile 忽略隐藏文件与常见的未完成下载的临时文件
+func ignoreHotFile(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~") {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".part" || ext == ".tmp" || ext == ".crdownload"
+}
+
+// debounceHotFile 文件每次变化都重新计时，超过HotFolderDebounce没有变化后加入发送队列
+func debounceHotFile(path string) {
+	hotLock.Lock()
+	defer hotLock.Unlock()
+	if hotWatcher == nil {
+		return
+	}
+	if timer, ok := hotTimers[path]; ok {
+		timer.Reset(HotFolderDebounce)
+		return
+	}
+	hotTimers[path] = time.AfterFunc(HotFolderDebounce, func() {
+		hotLock.Lock()
+		defer hotLock.Unlock()
+		delete(hotTimers, path)
+		if hotQueue == nil {
+			return
+		}
+		stat, err := os.Stat(path)
+		if err != nil || !stat.Mode().IsRegular() {
+			return
+		}
+		select {
+		case hotQueue <- path:
+		default:
+			LogWarn("Hot folder queue is full", FFile(path))
+		}
+	})
+}
+
+func sendHotFolder(queue chan string, stop chan struct{}, config HotFolderConfig) {
+	for {
+		var path string
+		select {
+		case <-stop:
+			return
+		case path = <-queue:
+		}
+		//队列与停止同时就绪时select随机选择，发送前再检查一次
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		peer, err := ParseTarget(config.Target)
+		if err != nil {
+			LogErr("Hot folder target is illegal:" + err.Error())
+			continue
+		}
+		Log("Hot folder send", FFile(path), FPeer(peer.Address()))
+		if err = SendToPeers(path, []Peer{peer}, OriginHotFolder)[0]; err != nil {
+			LogErr("Hot folder send error:"+err.Error(), FFile(path), FPeer(peer.Address()))
+			continue
+		}
+		afterHotFileSent(path, config)
+	}
+}
+
+// afterHotFileSent 按设置保留、移动或删除发送成功的文件
+func afterHotFileSent(path string, config HotFolderConfig) {
+	switch config.After {
+	case HotFolderMove:
+		dir := filepath.Join(config.Dir, HotFolderSentDir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			LogErr("Hot folder move error:"+err.Error(), FFile(path))
+			return
+		}
+		//sent中已有同名文件时按重命名处理，不覆盖之前发送的文件
+		file, target, err := createUniqueFile(dir, filepath.Base(path), false)
+		if err != nil {
+			LogErr("Hot folder move error:"+err.Error(), FFile(path))
+			return
+		}
+		file.Close()
+		if err = os.Rename(path, target); err != nil {
+			os.Remove(target)
+			LogErr("Hot folder move error:"+err.Error(), FFile(path))
+			return
+		}
+		Log("Hot folder moved sent file", FFile(path), F("to", target))
+	case HotFolderDelete:
+		if err := os.Remove(path); err != nil {
+			LogErr("Hot folder delete error:"+err.Error(), FFile(path))
+			return
+		}
+		Log("Hot folder deleted sent file", FFile(path))
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import "sync"
+
+// 接收端因大小限制拒绝时回复的原因
+const (
+	RejectNoSpace      = "insufficient space"
+	RejectTooLarge     = "file too large"
+	RejectSessionLimit = "session size limit exceeded"
+)
+
+// sessionReceived 本次开启接收以来已接受的字节数，用于Setting.ReceiveSessionLimit
+var sessionReceived int64
+
+// pendingReceive 正在接收的文件还需要的字节数，检查剩余空间时一并扣除
+var pendingReceive int64
+var sessionLock sync.Mutex
+
+// FormatSizeLimit 设置页显示的大小限制，0为空
+func FormatSizeLimit(size int64) string {
+	if size <= 0 {
+		return ""
+	}
+	return FormatByteSize(size, 1)
+}
+
+// ResetReceiveSession 开启接收时重新计数
+func ResetReceiveSession() {
+	sessionLock.Lock()
+	sessionReceived = 0
+	sessionLock.Unlock()
+}
+
+// ReserveReceive 接受大小为size的文件前检查限制与剩余空间，need为还需要接收的字节数(续传时小于size)
+// 返回拒绝原因，为空时已计入本次接收的总量，接收结束后需调用FinishReceive
+func ReserveReceive(dir string, size, need int64) string {
+	if Setting.ReceiveFileLimit > 0 && size > Setting.ReceiveFileLimit {
+		return RejectTooLarge
+	}
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	if Setting.ReceiveSessionLimit > 0 && sessionReceived+need > Setting.ReceiveSessionLimit {
+		return RejectSessionLimit
+	}
+	free, err := DiskFree(dir)
+	if err != nil {
+		LogWarn("Unable to check free space:"+err.Error(), F("dir", dir))
+	} else if need+pendingReceive > free {
+		return RejectNoSpace
+	}
+	sessionReceived += need
+	pendingReceive += need
+	return ""
+}
+
+// FinishReceive 接收结束，unreceived为失败时没有接收的字节数，从本次接收的总量中退还
+func FinishReceive(need, unreceived int64) {
+	sessionLock.Lock()
+	pendingReceive -= need
+	if unreceived > 0 {
+		sessionReceived -= unreceived
+	}
+	sessionLock.Unlock()
+}
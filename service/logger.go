@@ -0,0 +1,240 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level uint8
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"Debug", "Info", "Warn", "Error"}
+
+func (l Level) String() string {
+	if int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return "Unknown"
+}
+
+// ParseLevel 由名称解析日志级别，无法识别时为Info
+func ParseLevel(name string) Level {
+	for i, levelName := range levelNames {
+		if levelName == name {
+			return Level(i)
+		}
+	}
+	return LevelInfo
+}
+
+// Field 日志的结构化字段
+type Field struct {
+	Key   string
+	Value any
+}
+
+func F(key string, value any) Field {
+	return Field{Key: key, Value: value}
+}
+func FPeer(peer string) Field {
+	return Field{Key: "peer", Value: peer}
+}
+func FFile(file string) Field {
+	return Field{Key: "file", Value: file}
+}
+func FBytes(n int64) Field {
+	return Field{Key: "bytes", Value: n}
+}
+
+// LogRecord 一条日志
+type LogRecord struct {
+	Time   time.Time
+	Level  Level
+	Msg    string
+	Fields []Field
+}
+
+// Format 格式化为一行文本
+func (r LogRecord) Format() string {
+	builder := strings.Builder{}
+	builder.WriteString("[")
+	builder.WriteString(r.Time.Format("2006-01-02 15:04:05"))
+	builder.WriteString("] ")
+	if r.Level != LevelInfo {
+		builder.WriteString("[")
+		builder.WriteString(r.Level.String())
+		builder.WriteString("] ")
+	}
+	builder.WriteString(r.Msg)
+	for _, field := range r.Fields {
+		value := fmt.Sprint(field.Value)
+		if strings.ContainsAny(value, " \t\n\"=") || value == "" {
+			value = strconv.Quote(value)
+		}
+		builder.WriteString(" ")
+		builder.WriteString(field.Key)
+		builder.WriteString("=")
+		builder.WriteString(value)
+	}
+	builder.WriteString("\n")
+	return builder.String()
+}
+
+// LogBufferSize 界面中保留的日志条数
+const LogBufferSize = 500
+
+// 日志文件轮转参数
+const (
+	LogFileMaxSize = 1 << 20
+	LogFileBackups = 3
+)
+
+var logLock sync.Mutex
+var logBuffer = make([]LogRecord, 0, LogBufferSize)
+var logFile *RotateWriter
+
+// LogLevel 界面中显示的最低日志级别
+var LogLevel = LevelInfo
+
+// InitLogFile 在配置目录下的logs目录写入日志文件
+func InitLogFile() {
+	dir, err := ConfigFile("logs")
+	if err != nil {
+		LogErr("Init log file error:" + err.Error())
+		return
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		LogErr("Init log file error:" + err.Error())
+		return
+	}
+	logLock.Lock()
+	logFile = NewRotateWriter(filepath.Join(dir, "lan_transfer.log"), LogFileMaxSize, LogFileBackups)
+	logLock.Unlock()
+	Log("Log file:" + logFile.path)
+}
+
+func writeLog(level Level, msg string, fields []Field) {
+	record := LogRecord{Time: time.Now(), Level: level, Msg: msg, Fields: fields}
+	formatMsg := record.Format()
+	fmt.Print(formatMsg)
+	logLock.Lock()
+	if logFile != nil {
+		if _, err := logFile.Write([]byte(formatMsg)); err != nil {
+			fmt.Print("write log file error:" + err.Error() + "\n")
+		}
+	}
+	if len(logBuffer) >= LogBufferSize {
+		copy(logBuffer, logBuffer[1:])
+		logBuffer = logBuffer[:len(logBuffer)-1]
+	}
+	logBuffer = append(logBuffer, record)
+	logLock.Unlock()
+	if level >= LogLevel {
+		RefreshLogger()
+	}
+}
+
+// RefreshLogger 按级别过滤后把日志缓冲显示到界面
+func RefreshLogger() {
+	if Logger == nil {
+		return
+	}
+	builder := strings.Builder{}
+	logLock.Lock()
+	for _, record := range logBuffer {
+		if record.Level >= LogLevel {
+			builder.WriteString(record.Format())
+		}
+	}
+	logLock.Unlock()
+	Logger.SetText(builder.String())
+	LogScroll.ScrollToBottom()
+}
+
+func LogDebug(msg string, fields ...Field) {
+	writeLog(LevelDebug, msg, fields)
+}
+func Log(msg string, fields ...Field) {
+	writeLog(LevelInfo, msg, fields)
+}
+func LogWarn(msg string, fields ...Field) {
+	writeLog(LevelWarn, msg, fields)
+}
+func LogErr(msg string, fields ...Field) {
+	writeLog(LevelError, msg, fields)
+}
+
+// RotateWriter 按大小轮转的日志文件
+type RotateWriter struct {
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func NewRotateWriter(path string, maxSize int64, backups int) *RotateWriter {
+	return &RotateWriter{path: path, maxSize: maxSize, backups: backups}
+}
+func (r *RotateWriter) Write(p []byte) (n int, err error) {
+	if r.file == nil {
+		if err = r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size+int64(len(p)) > r.maxSize {
+		if err = r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = r.file.Write(p)
+	r.size += int64(n)
+	return
+}
+func (r *RotateWriter) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = stat.Size()
+	return nil
+}
+
+// rotate lan_transfer.log -> lan_transfer.log.1 -> ... 超出份数的删除
+func (r *RotateWriter) rotate() error {
+	r.file.Close()
+	r.file = nil
+	os.Remove(r.path + "." + strconv.Itoa(r.backups))
+	for i := r.backups - 1; i > 0; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+func (r *RotateWriter) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
@@ -0,0 +1,375 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+文件夹镜像(KindMirror)，传输头之后:
+发送端 -> 接收端: MirrorRequest(json帧)
+接收端 -> 发送端: MirrorPlan(json帧)，列出需要发送的文件与目标多余的文件
+非预览时发送端按Need的顺序发送每个文件: fileSize(8) fileContent md5(16)
+接收端全部接收后删除多余的文件(需接收端允许)，回复MirrorPlan(json帧)，Error为空表示成功
+*/
+
+// MirrorEntry 清单中的一个文件，Path为相对镜像根目录、以/分隔的路径
+type MirrorEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// MirrorRequest 发送端的镜像请求与本地清单
+type MirrorRequest struct {
+	Folder string        `json:"folder"`
+	DryRun bool          `json:"dryRun"`
+	Delete bool          `json:"delete"`
+	Files  []MirrorEntry `json:"files"`
+}
+
+// MirrorPlan 接收端对比清单后的结果
+type MirrorPlan struct {
+	Need  []string `json:"need"`
+	Extra []string `json:"extra"`
+	Error string   `json:"error,omitempty"`
+}
+
+// mirrorTempSuffix 接收中的临时文件后缀，校验通过后才覆盖目标文件
+const mirrorTempSuffix = ".lantpart"
+
+// BuildManifest 遍历文件夹生成清单
+func BuildManifest(root string) ([]MirrorEntry, error) {
+	entries := make([]MirrorEntry, 0)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || filepath.Ext(path) == mirrorTempSuffix {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sum, size, err := fileMD5(path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, MirrorEntry{Path: filepath.ToSlash(rel), Size: size, MD5: sum})
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, err
+}
+
+func fileMD5(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := md5.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+// mirrorPath 把清单中的相对路径转换为本地路径，拒绝越出镜像根目录的路径
+func mirrorPath(root, rel string) (string, error) {
+	local := filepath.FromSlash(rel)
+	if !filepath.IsLocal(local) {
+		return "", errors.New("illegal mirror path:" + rel)
+	}
+	return filepath.Join(root, local), nil
+}
+
+// RejectMirrorDelete 接收端没有允许镜像删除文件时回复的原因
+const RejectMirrorDelete = "deleting files is not allowed on receiver"
+
+// mirrorFolder 检查接收端的镜像文件夹名，必须是下载路径下的子文件夹
+func mirrorFolder(folder string) (string, error) {
+	local := filepath.Clean(filepath.FromSlash(folder))
+	if local == "." || !filepath.IsLocal(local) {
+		return "", errors.New("illegal mirror folder:" + folder)
+	}
+	return local, nil
+}
+
+// PlanMirror 对比发送端清单与本地文件夹，得到需要发送的文件与多余的文件
+func PlanMirror(root string, files []MirrorEntry) (MirrorPlan, error) {
+	plan := MirrorPlan{Need: make([]string, 0), Extra: make([]string, 0)}
+	local := map[string]bool{}
+	for _, entry := range files {
+		path, err := mirrorPath(root, entry.Path)
+		if err != nil {
+			return plan, err
+		}
+		local[entry.Path] = true
+		stat, err := os.Stat(path)
+		if err == nil && stat.Mode().IsRegular() && stat.Size() == entry.Size {
+			if sum, _, err := fileMD5(path); err == nil && sum == entry.MD5 {
+				continue
+			}
+		}
+		plan.Need = append(plan.Need, entry.Path)
+	}
+	if _, err := os.Stat(root); errors.Is(err, os.ErrNotExist) {
+		return plan, nil
+	}
+	existing, err := BuildManifest(root)
+	if err != nil {
+		return plan, err
+	}
+	for _, entry := range existing {
+		if !local[entry.Path] {
+			plan.Extra = append(plan.Extra, entry.Path)
+		}
+	}
+	return plan, nil
+}
+
+// MirrorFolder 把本地文件夹镜像到接收端的下载路径下的folder文件夹，dryRun时只返回对比结果
+func MirrorFolder(peer Peer, root, folder string, dryRun, deleteExtra bool) (MirrorPlan, error) {
+	var plan MirrorPlan
+	if _, err := mirrorFolder(folder); err != nil {
+		return plan, err
+	}
+	files, err := BuildManifest(root)
+	if err != nil {
+		return plan, errors.Join(errors.New("error reading folder"), err)
+	}
+	address := peer.Address()
+	header := Header{Kind: KindMirror, Id: NewTransferId(), DeviceName: Setting.DeviceName, Token: peer.Token}
+	conn, _, err := dialTransfer(peer, header, nil)
+	if err != nil {
+		return plan, err
+	}
+	defer conn.Close()
+	request := MirrorRequest{Folder: folder, DryRun: dryRun, Delete: deleteExtra, Files: files}
+	if err = WriteFrame(conn, request); err != nil {
+		return plan, err
+	}
+	if err = ReadFrame(conn, &plan); err != nil {
+		return plan, err
+	}
+	if plan.Error != "" {
+		return plan, errors.New(plan.Error)
+	}
+	Log("Mirror plan", FPeer(address), F("folder", folder), F("need", len(plan.Need)), F("extra", len(plan.Extra)), F("dryRun", dryRun))
+	if dryRun {
+		return plan, nil
+	}
+	transfer := NewTransfer(header.Id, DirectionSent, address, peer.Name, conn)
+	defer transfer.Done()
+	transfer.SetOrigin(OriginSender)
+	for _, rel := range plan.Need {
+		startTime := time.Now()
+		path, _ := mirrorPath(root, rel)
+		result, err := sendMirrorFile(conn, path, rel, transfer)
+		RecordTransfer(DirectionSent, address, result, startTime, err)
+		if err != nil {
+			return plan, err
+		}
+	}
+	var done MirrorPlan
+	if err = ReadFrame(conn, &done); err != nil {
+		return plan, err
+	}
+	if done.Error != "" {
+		return plan, errors.New(done.Error)
+	}
+	Log("Mirror finished", FPeer(address), F("folder", folder), F("sent", len(plan.Need)))
+	return plan, nil
+}
+
+func sendMirrorFile(writer io.Writer, path, rel string, transfer *Transfer) (FileResult, error) {
+	result := FileResult{Name: rel, Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return result, errors.New("Fail to open file:" + err.Error())
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return result, errors.New("Failed to obtain file information:" + err.Error())
+	}
+	result.Size = stat.Size()
+	fileSize := make([]byte, 8)
+	binary.BigEndian.PutUint64(fileSize, uint64(stat.Size()))
+	if _, err = writer.Write(fileSize); err != nil {
+		return result, errors.New("Wrong file size sent:" + err.Error())
+	}
+	transfer.SetFile(rel, stat.Size())
+	hash := md5.New()
+	//文件在清单生成后可能被修改，按发送时的大小发送，大小或md5与清单不一致时接收端会拒绝
+	if _, err = CopyNBuffer(io.MultiWriter(writer, hash, transfer), NewRateLimitedReader(file, transfer), stat.Size(), bufGet(stat.Size())); err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return result, err
+		}
+		return result, errors.New("Error sending file:" + err.Error())
+	}
+	fileMD5 := hash.Sum(nil)
+	result.MD5 = hex.EncodeToString(fileMD5)
+	if _, err = writer.Write(fileMD5); err != nil {
+		return result, errors.New("Error sending md5:" + err.Error())
+	}
+	LogDebug("Mirror send file", FFile(rel), FBytes(stat.Size()))
+	return result, nil
+}
+
+// ReceiveMirror 接收文件夹镜像，文件保存在下载路径下请求的文件夹中
+func (r *ReceiveHandler) ReceiveMirror(conn net.Conn, header Header, address string, pbHook *MultipleProgressBarHook) {
+	var request MirrorRequest
+	if err := ReadFrame(conn, &request); err != nil {
+		LogErr("Receive mirror request error:"+err.Error(), FPeer(address))
+		return
+	}
+	reply := func(plan MirrorPlan, err error) {
+		if err != nil {
+			plan.Error = err.Error()
+		}
+		if errW := WriteFrame(conn, plan); errW != nil {
+			LogErr("Send mirror reply error:"+errW.Error(), FPeer(address))
+		}
+	}
+	folder, err := mirrorFolder(request.Folder)
+	if err != nil {
+		reply(MirrorPlan{}, err)
+		return
+	}
+	if request.Delete && !Setting.MirrorDelete {
+		LogWarn("Reject mirror:"+RejectMirrorDelete, FPeer(address), F("folder", request.Folder))
+		reply(MirrorPlan{}, errors.New(RejectMirrorDelete))
+		return
+	}
+	root := filepath.Join(r.fileSrc, folder)
+	plan, err := PlanMirror(root, request.Files)
+	if err != nil {
+		LogErr("Mirror plan error:"+err.Error(), FPeer(address))
+		reply(plan, err)
+		return
+	}
+	Log("Mirror request", FPeer(address), F("folder", request.Folder), F("need", len(plan.Need)), F("extra", len(plan.Extra)), F("dryRun", request.DryRun))
+	manifest := map[string]MirrorEntry{}
+	for _, entry := range request.Files {
+		manifest[entry.Path] = entry
+	}
+	//按需要发送的文件检查大小限制与剩余空间
+	var largest, need, received int64
+	for _, rel := range plan.Need {
+		need += manifest[rel].Size
+		if manifest[rel].Size > largest {
+			largest = manifest[rel].Size
+		}
+	}
+	if !request.DryRun {
+		if reason := ReserveReceive(r.fileSrc, largest, need); reason != "" {
+			LogWarn("Reject mirror:"+reason, FPeer(address), F("folder", request.Folder), FBytes(need))
+			reply(plan, errors.New(reason))
+			return
+		}
+		defer func() {
+			FinishReceive(need, need-received)
+		}()
+	}
+	reply(plan, nil)
+	if request.DryRun {
+		return
+	}
+	transfer := NewTransfer(header.Id, DirectionReceived, conn.RemoteAddr().String(), header.DeviceName, conn)
+	defer transfer.Done()
+	for _, rel := range plan.Need {
+		startTime := time.Now()
+		path, _ := mirrorPath(root, rel)
+		result, err := receiveMirrorFile(conn, path, rel, manifest[rel], pbHook, transfer)
+		RecordTransfer(DirectionReceived, address, result, startTime, err)
+		if err != nil {
+			LogErr("Receive mirror file error:"+err.Error(), FPeer(address), FFile(rel))
+			return
+		}
+		received += result.Size
+	}
+	//所有文件接收并校验通过后才删除多余的文件
+	if request.Delete {
+		for _, rel := range plan.Extra {
+			path, _ := mirrorPath(root, rel)
+			if err = os.Remove(path); err != nil {
+				LogErr("Mirror delete error:"+err.Error(), FFile(path))
+				continue
+			}
+			Log("Mirror deleted extraneous file", FFile(path))
+		}
+	}
+	reply(MirrorPlan{}, nil)
+	Log("Mirror received", FPeer(address), F("folder", request.Folder), F("files", len(plan.Need)))
+}
+
+// receiveMirrorFile 先写入临时文件，md5校验通过后覆盖目标文件，大小与md5都必须与清单中的expect一致
+func receiveMirrorFile(reader io.Reader, path, rel string, expect MirrorEntry, pbHook *MultipleProgressBarHook, transfer *Transfer) (FileResult, error) {
+	result := FileResult{Name: rel}
+	size, err := frameReader{reader}.uint64("file size")
+	if err != nil {
+		return result, err
+	}
+	if size > MaxFileSize || int64(size) != expect.Size {
+		return result, errors.New("file size differs from manifest")
+	}
+	num := int64(size)
+	result.Size = num
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return result, errors.Join(errors.New("error creating folder"), err)
+	}
+	tempPath := path + mirrorTempSuffix
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return result, errors.Join(errors.New("error creating file"), err)
+	}
+	hash := md5.New()
+	pbHook.AddPB(num, transfer)
+	transfer.SetFile(rel, num)
+	n, err := CopyNBuffer(io.MultiWriter(file, hash, pbHook, transfer), NewRateLimitedReader(reader, transfer), num, bufGet(num))
+	pbHook.RemovePb(n, num, transfer)
+	file.Close()
+	if err != nil {
+		errF := os.Remove(tempPath)
+		return result, errors.Join(errors.New("error reading file"), errF, err)
+	}
+	fileMD5, err := ReadFileMD5(reader)
+	if err != nil {
+		errF := os.Remove(tempPath)
+		return result, errors.Join(errors.New("error reading file md5"), errF, err)
+	}
+	if !bytes.Equal(fileMD5, hash.Sum(nil)) {
+		errF := os.Remove(tempPath)
+		return result, errors.Join(errors.New("error equal file md5"), errF)
+	}
+	//文件在清单生成后被修改时内容本身完整，但不是计划同步的版本
+	if !strings.EqualFold(hex.EncodeToString(fileMD5), expect.MD5) {
+		errF := os.Remove(tempPath)
+		return result, errors.Join(errors.New("file md5 differs from manifest"), errF)
+	}
+	if err = os.Rename(tempPath, path); err != nil {
+		errF := os.Remove(tempPath)
+		return result, errors.Join(errors.New("error replacing file"), errF, err)
+	}
+	result.Path = path
+	result.MD5 = hex.EncodeToString(fileMD5)
+	Log("Mirror received file", FFile(rel), FBytes(num), F("md5", result.MD5))
+	return result, nil
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/test"
+	"fyne.io/fyne/v2/widget"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mirrorStream 按协议编码镜像中的一个文件: fileSize(8) fileContent md5(16)
+func mirrorStream(content []byte) *bytes.Buffer {
+	stream := &bytes.Buffer{}
+	binary.Write(stream, binary.BigEndian, uint64(len(content)))
+	stream.Write(content)
+	sum := md5.Sum(content)
+	stream.Write(sum[:])
+	return stream
+}
+
+func TestReceiveMirrorFileManifest(t *testing.T) {
+	test.NewApp()
+	planned := []byte("version planned in the manifest")
+	changed := []byte("version changed after the plan!")
+	sum := md5.Sum(planned)
+	entry := MirrorEntry{Path: "a.txt", Size: int64(len(planned)), MD5: hex.EncodeToString(sum[:])}
+	for _, c := range []struct {
+		name    string
+		content []byte
+		entry   MirrorEntry
+		ok      bool
+	}{
+		{"matches", planned, entry, true},
+		{"md5 differs", changed, entry, false},
+		{"size differs", append(planned, '!'), entry, false},
+	} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "a.txt")
+		os.WriteFile(path, []byte("old"), 0644)
+		pbHook := NewMultipleProgressBarHook(widget.NewProgressBar(), canvas.NewText("", nil))
+		transfer := NewTransfer(NewTransferId(), DirectionReceived, "127.0.0.1:1", "pc", nil)
+		_, err := receiveMirrorFile(mirrorStream(c.content), path, "a.txt", c.entry, pbHook, transfer)
+		transfer.Done()
+		pbHook.Close()
+		want := []byte("old")
+		if c.ok {
+			want = c.content
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, want) {
+			t.Errorf("%s: file is %q, want %q", c.name, got, want)
+		}
+		if _, err := os.Stat(path + mirrorTempSuffix); !os.IsNotExist(err) {
+			t.Errorf("%s: temp file left", c.name)
+		}
+	}
+}
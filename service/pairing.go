@@ -0,0 +1,114 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+/**
+配对二维码内容:
+lant://host:port?name=设备名&token=配对码
+发送端把该内容粘贴到目标输入框(或输入后按回车)即可导入为书签
+设置了配对码时浏览器上传的地址为/?token=配对码，上传同样需要配对码
+*/
+
+const PairingScheme = "lant"
+
+// PairingQRSize 二维码图片边长
+const PairingQRSize = 256
+
+// PairingPayload 生成二维码中的配对内容，token为空时不包含配对码
+func PairingPayload(host string, port uint16, name, token string) string {
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	if token != "" {
+		query.Set("token", token)
+	}
+	u := url.URL{
+		Scheme:   PairingScheme,
+		Host:     net.JoinHostPort(host, strconv.Itoa(int(port))),
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// ParsePairingPayload 把配对内容解析为发送目标
+func ParsePairingPayload(payload string) (Peer, error) {
+	var peer Peer
+	u, err := url.Parse(payload)
+	if err != nil {
+		return peer, err
+	}
+	if u.Scheme != PairingScheme || u.User != nil || (u.Path != "" && u.Path != "/") || u.Fragment != "" {
+		return peer, errors.New("not a pairing payload")
+	}
+	if err = HostCheck(u.Hostname()); err != nil {
+		return peer, err
+	}
+	port, err := PortCheck(u.Port())
+	if err != nil {
+		return peer, err
+	}
+	peer.Host = u.Hostname()
+	peer.Port = port
+	peer.Name = u.Query().Get("name")
+	peer.Token = u.Query().Get("token")
+	if len(peer.Token) > 255 {
+		return peer, errors.New("pairing token too long")
+	}
+	if peer.Name == "" {
+		peer.Name = peer.Host
+	}
+	return peer, nil
+}
+
+// PairingQRCode 生成配对内容的二维码图片
+func PairingQRCode(payload string) (image.Image, error) {
+	qr, err := qrcode.New(payload, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	return qr.Image(PairingQRSize), nil
+}
+
+// NewPairingToken 生成随机配对码
+func NewPairingToken() string {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		LogErr("NewPairingToken Error:" + err.Error())
+	}
+	return hex.EncodeToString(token)
+}
+
+// CheckPairingToken 接收端未设置配对码时接受所有连接，否则只接受配对码一致的连接
+func CheckPairingToken(token string) bool {
+	if Setting.PairingToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(Setting.PairingToken)) == 1
+}
+
+// ImportPairing 导入配对内容，保存为书签并勾选为发送目标
+func ImportPairing(payload string) error {
+	peer, err := ParsePairingPayload(payload)
+	if err != nil {
+		return err
+	}
+	if err = AddBookmark(peer); err != nil {
+		return err
+	}
+	SListChecked[peer.Address()] = true
+	FillSenderTarget(peer)
+	RefreshSList()
+	Log("Import pairing", FPeer(peer.Address()), F("name", peer.Name), F("token", peer.Token != ""))
+	return nil
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"os"
+	"time"
+)
+
+// PartialKeep 连接中断后保留未接收完的文件等待续传的时间
+const PartialKeep = 10 * time.Minute
+
+// partialFile 连接中断时未接收完的文件，发送端用相同的传输id重连后从Written处续传
+type partialFile struct {
+	Path    string
+	Name    string
+	Size    int64
+	Written int64
+	timer   *time.Timer
+}
+
+var partialFiles = SyncMap[TransferId, *partialFile]{}
+
+// canceledTransfers 接收端取消的传输，发送端重试时直接拒绝
+var canceledTransfers = SyncMap[TransferId, time.Time]{}
+
+// keepPartial 保留未接收完的文件，超过PartialKeep没有续传则删除
+func keepPartial(id TransferId, partial *partialFile) {
+	partial.timer = time.AfterFunc(PartialKeep, func() {
+		if p, ok := partialFiles.Load(id); ok && p == partial {
+			partialFiles.Delete(id)
+			if err := os.Remove(partial.Path); err == nil {
+				Log("Removed expired partial file", FFile(partial.Path))
+			}
+		}
+	})
+	partialFiles.Store(id, partial)
+	Log("Keep partial file for resume", FFile(partial.Path), FBytes(partial.Written), F("id", id))
+}
+
+// takePartial 取出等待续传的文件
+func takePartial(id TransferId) (*partialFile, bool) {
+	partial, ok := partialFiles.Load(id)
+	if !ok {
+		return nil, false
+	}
+	partialFiles.Delete(id)
+	partial.timer.Stop()
+	return partial, true
+}
+
+// wasCanceled 传输是否已被接收端取消，同时清理过期的记录
+func wasCanceled(id TransferId) bool {
+	canceledTransfers.Range(func(key TransferId, value time.Time) bool {
+		if time.Since(value) > PartialKeep {
+			canceledTransfers.Delete(key)
+		}
+		return true
+	})
+	_, ok := canceledTransfers.Load(id)
+	return ok
+}
+
+// RemovePartials 停止接收时删除所有等待续传的文件
+func RemovePartials() {
+	partialFiles.Range(func(key TransferId, value *partialFile) bool {
+		if partial, ok := takePartial(key); ok {
+			os.Remove(partial.Path)
+		}
+		return true
+	})
+}
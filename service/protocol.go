@@ -0,0 +1,415 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+/**
+tcp连接开头的传输头:
+magic(4) version(1) kind(1) transferId(16) deviceNameLen(1) deviceName tokenLen(1) token
+token为扫描二维码得到的配对码，接收端设置了配对码时只接受配对码一致的连接
+文件在传输头之后紧接着发送:
+fileNameLen(1) fileName fileSize(8)
+fileName不能为空或包含路径，fileSize不超过MaxFileSize
+接收端读取传输头(文件为文件名与大小之后)后回复:
+status(1) offset(8) reasonLen(1) reason
+status为ReplyAccept时发送端继续发送，offset为接收端已确认的字节数(续传时非0)，否则reason为拒绝原因，
+如剩余空间不足时为RejectNoSpace
+之后为对应kind的内容，文件为:
+fileContent[offset:] md5(16)
+md5为整个文件的md5，接收端校验后再回复一次status(1) offset(8) reasonLen(1) reason，
+发送端收到ReplyAccept才认为发送成功，连接在此之前中断时用相同的transferId重连续传
+文件内容期间接收端暂停或恢复时先发送status为ReplyPause/ReplyResume的回复，发送端在接收端暂停期间不按空闲超时断开，
+接收端每隔ProgressReplyInterval发送status为ReplyProgress、offset为已接收字节数的回复，
+发送端写完内容后只要仍收到进度回复就继续等待校验结果
+文本为:
+textLen(4) text
+文件夹镜像见mirror.go，其中的json帧为:
+frameLen(4) json
+udp控制信号发送到接收端的端口，内容为transferId(16)时停止传输，
+为status(1) transferId(16)且status为ReplyPause/ReplyResume时表示发送端暂停或恢复
+*/
+
+const protocolMagic = "LANT"
+
+const ProtocolVersion byte = 5
+
+const (
+	KindFile byte = iota + 1
+	KindText
+	KindMirror
+)
+
+// 接收端对传输头的回复状态
+const (
+	ReplyAccept byte = iota
+	ReplyReject
+	ReplyPause
+	ReplyResume
+	ReplyProgress
+)
+
+// ProgressReplyInterval 接收文件内容期间发送进度回复的最短间隔
+const ProgressReplyInterval = time.Second
+
+// MaxTextSize 单条文本的最大字节数
+const MaxTextSize = 1 << 20
+
+// MaxFrameSize 单个json帧的最大字节数
+const MaxFrameSize = 64 << 20
+
+// MaxFileSize 单个文件的最大字节数
+const MaxFileSize = 1 << 44
+
+// TransferId 每个传输唯一的id，由发送端生成
+type TransferId [16]byte
+
+// NewTransferId 生成随机的传输id
+func NewTransferId() TransferId {
+	var id TransferId
+	if _, err := rand.Read(id[:]); err != nil {
+		LogErr("NewTransferId Error:" + err.Error())
+	}
+	return id
+}
+func (id TransferId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseTransferId 从停止信号等字节中解析传输id
+func ParseTransferId(b []byte) (TransferId, error) {
+	var id TransferId
+	if len(b) != len(id) {
+		return id, errors.New("transfer id length error")
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// Header 传输头
+type Header struct {
+	Kind       byte
+	Id         TransferId
+	DeviceName string
+	Token      string
+}
+
+// WriteHeader 发送传输头
+func WriteHeader(writer io.Writer, header Header) error {
+	deviceName := []byte(header.DeviceName)
+	if len(deviceName) > 255 {
+		deviceName = deviceName[:255]
+	}
+	token := []byte(header.Token)
+	if len(token) > 255 {
+		return errors.New("pairing token too long")
+	}
+	buf := make([]byte, 0, len(protocolMagic)+2+len(header.Id)+1+len(deviceName)+1+len(token))
+	buf = append(buf, protocolMagic...)
+	buf = append(buf, ProtocolVersion, header.Kind)
+	buf = append(buf, header.Id[:]...)
+	buf = append(buf, byte(len(deviceName)))
+	buf = append(buf, deviceName...)
+	buf = append(buf, byte(len(token)))
+	buf = append(buf, token...)
+	if _, err := writer.Write(buf); err != nil {
+		return errors.New("Wrong header sent:" + err.Error())
+	}
+	return nil
+}
+
+// ReadHeader 读取传输头
+func ReadHeader(reader io.Reader) (Header, error) {
+	var header Header
+	r := frameReader{reader}
+	magic, err := r.bytes(len(protocolMagic), "header")
+	if err != nil {
+		return header, err
+	}
+	if string(magic) != protocolMagic {
+		return header, errors.New("header magic error")
+	}
+	version, err := r.uint8("protocol version")
+	if err != nil {
+		return header, err
+	}
+	if version != ProtocolVersion {
+		return header, errors.New("unsupported protocol version")
+	}
+	if header.Kind, err = r.uint8("transfer kind"); err != nil {
+		return header, err
+	}
+	id, err := r.bytes(len(header.Id), "transfer id")
+	if err != nil {
+		return header, err
+	}
+	copy(header.Id[:], id)
+	if header.DeviceName, err = r.string8("device name"); err != nil {
+		return header, err
+	}
+	if header.Token, err = r.string8("pairing token"); err != nil {
+		return header, err
+	}
+	return header, nil
+}
+
+// WriteText 发送文本
+func WriteText(writer io.Writer, text string) error {
+	if len(text) > MaxTextSize {
+		return errors.New("text too long")
+	}
+	buf := make([]byte, 4, 4+len(text))
+	binary.BigEndian.PutUint32(buf, uint32(len(text)))
+	buf = append(buf, text...)
+	if _, err := writer.Write(buf); err != nil {
+		return errors.New("Wrong text sent:" + err.Error())
+	}
+	return nil
+}
+
+// ReadText 读取文本
+func ReadText(reader io.Reader) (string, error) {
+	r := frameReader{reader}
+	n, err := r.uint32("text length")
+	if err != nil {
+		return "", err
+	}
+	if n > MaxTextSize {
+		return "", errors.New("text too long")
+	}
+	text, err := r.bytes(int(n), "text")
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// WriteFrame 以json帧发送v
+func WriteFrame(writer io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxFrameSize {
+		return errors.New("frame too long")
+	}
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	if _, err = writer.Write(buf); err != nil {
+		return errors.New("Wrong frame sent:" + err.Error())
+	}
+	return nil
+}
+
+// ReadFrame 读取json帧到v
+func ReadFrame(reader io.Reader, v any) error {
+	r := frameReader{reader}
+	n, err := r.uint32("frame length")
+	if err != nil {
+		return err
+	}
+	if n > MaxFrameSize {
+		return errors.New("frame too long")
+	}
+	data, err := r.bytes(int(n), "frame")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Reply 接收端对传输头的回复
+type Reply struct {
+	Status byte
+	Offset int64
+	Reason string
+}
+
+// RejectedError 接收端拒绝了传输，重试也不会成功
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected by receiver:" + e.Reason
+}
+
+// WriteReply 回复发送端
+func WriteReply(writer io.Writer, reply Reply) error {
+	reason := []byte(reply.Reason)
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	buf := make([]byte, 10, 10+len(reason))
+	buf[0] = reply.Status
+	binary.BigEndian.PutUint64(buf[1:9], uint64(reply.Offset))
+	buf[9] = byte(len(reason))
+	buf = append(buf, reason...)
+	if _, err := writer.Write(buf); err != nil {
+		return errors.Join(errors.New("wrong reply sent"), err)
+	}
+	return nil
+}
+
+// ReadReply 读取接收端的回复，被拒绝时返回RejectedError
+func ReadReply(reader io.Reader) (Reply, error) {
+	reply, err := readReplyFrame(reader)
+	if err != nil {
+		return reply, err
+	}
+	return reply, checkReply(reply)
+}
+
+// ReadContentReply 读取文件内容期间接收端的回复，ReplyPause、ReplyResume与ReplyProgress不作为拒绝
+func ReadContentReply(reader io.Reader) (Reply, error) {
+	reply, err := readReplyFrame(reader)
+	if err != nil || reply.Status == ReplyPause || reply.Status == ReplyResume || reply.Status == ReplyProgress {
+		return reply, err
+	}
+	return reply, checkReply(reply)
+}
+
+func readReplyFrame(reader io.Reader) (Reply, error) {
+	var reply Reply
+	r := frameReader{reader}
+	var err error
+	if reply.Status, err = r.uint8("reply"); err != nil {
+		return reply, err
+	}
+	offset, err := r.uint64("reply offset")
+	if err != nil {
+		return reply, err
+	}
+	reply.Offset = int64(offset)
+	reply.Reason, err = r.string8("reply reason")
+	return reply, err
+}
+
+func checkReply(reply Reply) error {
+	if reply.Status != ReplyAccept {
+		return &RejectedError{Reason: reply.Reason}
+	}
+	if reply.Offset < 0 {
+		return errors.New("reply offset error")
+	}
+	return nil
+}
+
+// FileHeader 文件内容之前的文件名与大小
+type FileHeader struct {
+	Name string
+	Size int64
+}
+
+// WriteFileHeader 发送文件名与大小
+func WriteFileHeader(writer io.Writer, file FileHeader) error {
+	if err := checkFileName(file.Name); err != nil {
+		return err
+	}
+	if file.Size < 0 || file.Size > MaxFileSize {
+		return errors.New("file too large")
+	}
+	buf := make([]byte, 0, 1+len(file.Name)+8)
+	buf = append(buf, byte(len(file.Name)))
+	buf = append(buf, file.Name...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(file.Size))
+	if _, err := writer.Write(buf); err != nil {
+		return errors.Join(errors.New("wrong file header sent"), err)
+	}
+	return nil
+}
+
+// ReadFileHeader 读取文件名与大小，拒绝不合法的文件名与超出MaxFileSize的大小
+func ReadFileHeader(reader io.Reader) (FileHeader, error) {
+	var file FileHeader
+	r := frameReader{reader}
+	name, err := r.string8("file name")
+	if err != nil {
+		return file, err
+	}
+	if err = checkFileName(name); err != nil {
+		return file, err
+	}
+	file.Name = name
+	size, err := r.uint64("file size")
+	if err != nil {
+		return file, err
+	}
+	if size > MaxFileSize {
+		return file, errors.New("file too large")
+	}
+	file.Size = int64(size)
+	return file, nil
+}
+
+// ReadFileMD5 读取文件内容之后的md5
+func ReadFileMD5(reader io.Reader) ([]byte, error) {
+	return frameReader{reader}.bytes(md5.Size, "file md5")
+}
+
+// checkFileName 文件名不能为空，也不能包含路径
+func checkFileName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\\\x00") {
+		return errors.New("illegal file name:" + name)
+	}
+	return nil
+}
+
+// frameReader 按字段完整读取协议内容，短读时继续读取，连接在字段中途断开时返回io.ErrUnexpectedEOF
+type frameReader struct {
+	reader io.Reader
+}
+
+func (r frameReader) bytes(n int, field string) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		return nil, errors.Join(errors.New("error reading "+field), err)
+	}
+	return buf, nil
+}
+
+func (r frameReader) uint8(field string) (byte, error) {
+	buf, err := r.bytes(1, field)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (r frameReader) uint32(field string) (uint32, error) {
+	buf, err := r.bytes(4, field)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+func (r frameReader) uint64(field string) (uint64, error) {
+	buf, err := r.bytes(8, field)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// string8 读取1字节长度开头的字符串
+func (r frameReader) string8(field string) (string, error) {
+	n, err := r.uint8(field + " length")
+	if err != nil {
+		return "", err
+	}
+	buf, err := r.bytes(int(n), field)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter 按字节每秒限速，rate为0时不限速，可在传输过程中修改
+type RateLimiter struct {
+	lock sync.Mutex
+	rate int64
+	//next 已放行的字节按限速全部发完的时间
+	next time.Time
+}
+
+// rateBurst 空闲后允许立即放行的时长
+const rateBurst = 100 * time.Millisecond
+
+// GlobalLimiter 所有传输共享的限速
+var GlobalLimiter = &RateLimiter{}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate}
+}
+
+// SetRate 修改限速，立即生效
+func (l *RateLimiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.next = time.Now()
+}
+func (l *RateLimiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// Wait 等待直到n字节可以按限速通过
+func (l *RateLimiter) Wait(n int) {
+	l.lock.Lock()
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now.Add(-rateBurst)) {
+		l.next = now.Add(-rateBurst)
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	wait := l.next.Sub(now)
+	l.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// chunk 限速时单次读取的字节数，避免大缓冲区造成突发
+func (l *RateLimiter) chunk() int {
+	rate := l.Rate()
+	if rate <= 0 {
+		return 0
+	}
+	if rate/20 < 1<<10 {
+		return 1 << 10
+	}
+	return int(rate / 20)
+}
+
+// RateLimitedReader 按全局限速与各传输的限速读取，多个传输共用同一读取时以最低的限速为准
+type RateLimitedReader struct {
+	reader    io.Reader
+	transfers []*Transfer
+}
+
+func NewRateLimitedReader(reader io.Reader, transfers ...*Transfer) *RateLimitedReader {
+	return &RateLimitedReader{reader: reader, transfers: transfers}
+}
+func (r *RateLimitedReader) Read(p []byte) (int, error) {
+	limiters := make([]*RateLimiter, 1, len(r.transfers)+1)
+	limiters[0] = GlobalLimiter
+	for _, transfer := range r.transfers {
+		if transfer != nil {
+			limiters = append(limiters, transfer.limiter)
+		}
+	}
+	for _, limiter := range limiters {
+		if chunk := limiter.chunk(); chunk > 0 && chunk < len(p) {
+			p = p[:chunk]
+		}
+	}
+	n, err := r.reader.Read(p)
+	for _, limiter := range limiters {
+		limiter.Wait(n)
+	}
+	return n, err
+}
+
+// ParseRate 解析限速文本，如500K、2M、1.5G，单位为字节每秒，空或0表示不限速
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	return ParseByteSize(strings.TrimSuffix(s, "/S"))
+}
+
+// FormatRate 格式化限速，不限速时为空
+func FormatRate(rate int64) string {
+	if rate <= 0 {
+		return ""
+	}
+	return FormatByteSpeed(rate, 1)
+}
+
+// RateCapText 速度文本后显示的限速
+func RateCapText(rate int64) string {
+	if rate <= 0 {
+		return ""
+	}
+	return " cap:" + FormatRate(rate)
+}
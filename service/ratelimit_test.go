@@ -0,0 +1,96 @@
+package service
+
+import (
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/test"
+	"fyne.io/fyne/v2/widget"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"500", 500, true},
+		{"500K", 500 << 10, true},
+		{" 2m/s ", 2 << 20, true},
+		{"1.5GB/s", 3 << 29, true},
+		{"1T", 1 << 40, true},
+		{"7E", 0, false},
+		{"-1K", 0, false},
+		{"abc", 0, false},
+		{"NaN", 0, false},
+		{"nanK", 0, false},
+		{"Inf", 0, false},
+		{"+InfM", 0, false},
+		{"-Inf", 0, false},
+		{"1e30", 0, false},
+		{"9223372036854775807", 0, false},
+		{"8388608T", 0, false},
+		{"8388607T", 8388607 << 40, true},
+	} {
+		got, err := ParseRate(c.text)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("ParseRate(%q) = %d %v, want %d ok=%v", c.text, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestTransferLimit(t *testing.T) {
+	saved := GlobalLimiter.Rate()
+	defer GlobalLimiter.SetRate(saved)
+	for _, c := range []struct {
+		transfer, global, want int64
+	}{
+		{0, 0, 0},
+		{100, 0, 100},
+		{0, 100, 100},
+		{100, 200, 100},
+		{200, 100, 100},
+	} {
+		GlobalLimiter.SetRate(c.global)
+		transfer := &Transfer{limiter: NewRateLimiter(c.transfer)}
+		if got := transfer.Limit(); got != c.want {
+			t.Errorf("transfer %d global %d: Limit() = %d, want %d", c.transfer, c.global, got, c.want)
+		}
+	}
+}
+
+func TestProgressBarHookLimit(t *testing.T) {
+	test.NewApp()
+	saved := GlobalLimiter.Rate()
+	defer GlobalLimiter.SetRate(saved)
+	GlobalLimiter.SetRate(0)
+	slow, fast := &Transfer{limiter: NewRateLimiter(100)}, &Transfer{limiter: NewRateLimiter(200)}
+	hook := NewProgressBarHook(widget.NewProgressBar(), canvas.NewText("", nil), 10, fast, nil, slow)
+	defer hook.Close()
+	//单独限速而没有全局限速时进度条上同样显示限速
+	if got := hook.Limit(); got != 100 {
+		t.Errorf("sender hook limit %d, want 100", got)
+	}
+	GlobalLimiter.SetRate(50)
+	if got := hook.Limit(); got != 50 {
+		t.Errorf("sender hook limit %d, want the global 50", got)
+	}
+
+	GlobalLimiter.SetRate(0)
+	multiple := NewMultipleProgressBarHook(widget.NewProgressBar(), canvas.NewText("", nil))
+	defer multiple.Close()
+	multiple.AddPB(10, fast)
+	if got := multiple.Limit(); got != 200 {
+		t.Errorf("receiver hook limit %d, want 200", got)
+	}
+	multiple.AddPB(10, slow)
+	multiple.RemovePb(10, 10, fast)
+	if got := multiple.Limit(); got != 100 {
+		t.Errorf("receiver hook limit %d, want 100", got)
+	}
+	multiple.RemovePb(10, 10, slow)
+	if got := multiple.Limit(); got != 0 {
+		t.Errorf("idle receiver hook limit %d, want 0", got)
+	}
+}
@@ -3,18 +3,17 @@ package service
 import (
 	"errors"
 	"fmt"
-	"math/rand"
+	"io"
 	"net"
 	"os"
-	"os/user"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
 /**
-Receive端口:tcp接收文件
-Receive端口+1:循环udp广播ip
+Receive端口:tcp接收文件，udp接收停止信号
+DiscoveryPort:udp回复发现查询，可选低频通告携带tcp端口的信标
 */
 
 type ReceiveHandler struct {
@@ -24,29 +23,28 @@ type ReceiveHandler struct {
 }
 
 var connStopSignal net.PacketConn
-var ReceivingConnMap = SyncMap[string, *net.Conn]{}
 var RListItemEnable = true
 var Receiver = ReceiveHandler{}
 
+// AnnounceInterval 定期通告间隔
+const AnnounceInterval = 10 * time.Second
+
 var listener net.Listener
-var stopBroadcastIp = make(chan struct{})
+var connDiscovery net.PacketConn
+var stopAnnounce chan struct{}
 
 // InitSetting 初始化设置
 func (r *ReceiveHandler) InitSetting() {
 	Log("Init Receiver")
 	r.state = Stopped
-	//设置默认接收端口
-	r.port = 32000
+	//读取设置中的接收端口与下载路径
+	r.port = Setting.ReceiverPort
 	ReceiverPortInput.SetText(strconv.Itoa(int(r.port)))
-	//设置默认下载路径
-	currentUser, err := user.Current()
-	if err != nil {
-		LogErr("Unable to obtain current user information" + err.Error())
-	} else {
-		// 获取默认下载目录路径
-		r.fileSrc = filepath.Join(currentUser.HomeDir, "Downloads")
-		ReceiverFileSrcInput.SetText(r.fileSrc)
-	}
+	r.fileSrc = Setting.DownloadDir
+	ReceiverFileSrcInput.SetText(r.fileSrc)
+	RIpInput.SetText(Setting.AnnounceIp)
+	ReceiverAnnounceCheck.SetChecked(Setting.Announce)
+	ReceiverWebCheck.SetChecked(Setting.WebUpload)
 	r.GetLanIp()
 	//r.AutofillIp()
 	Log("Init Receiver Succeed")
@@ -57,7 +55,7 @@ func (r *ReceiveHandler) Run() error {
 	Log("Run Receiver")
 	if r.state == Running {
 		err := errors.New("repeated start")
-		LogErr(err.Error())
+		LogWarn(err.Error())
 		return err
 	}
 	//端口检查
@@ -74,12 +72,30 @@ func (r *ReceiveHandler) Run() error {
 		return err
 	}
 
-	r.StartBroadcastIp()
+	Setting.ReceiverPort = r.port
+	Setting.DownloadDir = r.fileSrc
+	Setting.AnnounceIp = RIpInput.Text
+	Setting.Announce = ReceiverAnnounceCheck.Checked
+	Setting.WebUpload = ReceiverWebCheck.Checked
+	SaveConfig()
+	ResetReceiveSession()
+
+	if ReceiverWebCheck.Checked {
+		if err = SetWebUpload(r.fileSrc); err != nil {
+			LogErr("Run web server error:" + err.Error())
+		} else {
+			ReceiverWebUrl.SetText(strings.Join(WebUrls(), " "))
+		}
+	}
+
+	r.RunDiscoveryResponder()
 	r.RunReceiveFile()
 	r.RunReceiverStopSignal()
 	ReceiverPortInput.Disable()
 	ReceiverFileSrcInput.Disable()
 	RIpInput.Disable()
+	ReceiverAnnounceCheck.Disable()
+	ReceiverWebCheck.Disable()
 	ReceiverFileSelectBtn.Disable()
 	RListItemEnable = false
 	r.state = Running
@@ -91,33 +107,37 @@ func (r *ReceiveHandler) Run() error {
 func (r *ReceiveHandler) Stop() {
 	if r.state == Stopped {
 		err := errors.New("repeated stop")
-		LogErr(err.Error())
+		LogWarn(err.Error())
 		return
 	}
 	Log("Stop Receiver")
-	stopBroadcastIp <- struct{}{}
-	ReceivingConnMap.Range(func(key string, value *net.Conn) bool {
-		defer ReceivingConnMap.Delete(key)
-		if (*value) != nil {
-			(*value).Close()
+	r.StopDiscoveryResponder()
+	SetWebUpload("")
+	ReceiverWebUrl.SetText("")
+	ActiveTransfers.Range(func(key TransferKey, value *Transfer) bool {
+		if value.Direction == DirectionReceived {
+			value.Cancel()
 		}
 		return true
 	})
 	if listener != nil {
 		listener.Close()
 	}
+	RemovePartials()
 	r.StopReceiverStopSignal()
 	ReceiverPortInput.Enable()
 	ReceiverFileSrcInput.Enable()
 	RIpInput.Enable()
+	ReceiverAnnounceCheck.Enable()
+	ReceiverWebCheck.Enable()
 	ReceiverFileSelectBtn.Enable()
 	RListItemEnable = true
 	r.state = Stopped
 	Log("Stop Receiver Succeed")
 }
 
-func (r *ReceiveHandler) PortS(offset uint16) string {
-	return strconv.FormatUint(uint64(r.port+offset), 10)
+func (r *ReceiveHandler) PortS() string {
+	return strconv.FormatUint(uint64(r.port), 10)
 }
 
 func (r *ReceiveHandler) SetFileSrc(src string) error {
@@ -135,19 +155,14 @@ func (r *ReceiveHandler) SetFileSrc(src string) error {
 
 // GetLanIp 获取局域网ip到列表
 func (r *ReceiveHandler) GetLanIp() {
-	localIpList := make([]string, 0)
-	addrs, err := net.InterfaceAddrs()
+	localIpList, err := LanBroadcastIps()
 	if err != nil {
 		LogErr("Error obtaining local IP address:" + err.Error())
 		return
 	}
 	Log("Get LAN address:")
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.IsPrivate() && ipnet.IP.To4() != nil {
-			lanIp := ReplaceLastOctet(ipnet.IP.String(), "255")
-			Log("LAN:" + lanIp)
-			localIpList = append(localIpList, lanIp)
-		}
+	for _, lanIp := range localIpList {
+		LogDebug("LAN:" + lanIp)
 	}
 	RefreshRList(localIpList)
 }
@@ -155,10 +170,10 @@ func (r *ReceiveHandler) GetLanIp() {
 // Deprecated: 没用
 // AutofillIp 测试局域网并尝试填入ip
 func (r *ReceiveHandler) AutofillIp() {
-	Log("Start auto fill IP, port:" + r.PortS(2))
+	Log("Start auto fill IP, port:" + r.PortS())
 	readyReceive := make(chan struct{}, 1)
 	go func() {
-		connR, err := net.ListenPacket("udp", ":"+r.PortS(2))
+		connR, err := net.ListenPacket("udp", ":"+r.PortS())
 		if err != nil {
 			LogErr("Link error:" + err.Error())
 			readyReceive <- struct{}{}
@@ -179,7 +194,7 @@ func (r *ReceiveHandler) AutofillIp() {
 	<-readyReceive
 
 	for _, listIp := range RListItems {
-		addr := listIp + ":" + r.PortS(2)
+		addr := listIp + ":" + r.PortS()
 		connW, err := net.Dial("udp", addr)
 		if err != nil {
 			LogErr("Link error with " + addr + " " + err.Error())
@@ -195,74 +210,89 @@ func (r *ReceiveHandler) AutofillIp() {
 	Log("Auto fill IP: send completed")
 }
 
-// StartBroadcastIp 开始向局域网广播ip
-func (r *ReceiveHandler) StartBroadcastIp() {
-	go func() {
-		sendAllLAN := false
-		Log("Start Broadcast Ip...")
-		//ip检查
-
-		if RIpInput.Text == "" && len(RListItems) > 0 {
-			sendAllLAN = true
-			Log("IP is not filled in, start LAN traversal sending mode")
-		} else {
-			err := IpCheck(RIpInput.Text)
+// RunDiscoveryResponder 监听发现查询并回复信标，勾选定期通告时低频主动通告
+func (r *ReceiveHandler) RunDiscoveryResponder() {
+	Log("Run Discovery Responder...")
+	var broadcastIps []string
+	if RIpInput.Text == "" {
+		broadcastIps = RListItems
+		Log("IP is not filled in, announce to all LAN")
+	} else {
+		err := IpCheck(RIpInput.Text)
+		if err != nil {
+			LogErr(err.Error())
+			return
+		}
+		broadcastIps = []string{RIpInput.Text}
+	}
+	var err error
+	connDiscovery, err = ListenDiscovery()
+	if err != nil {
+		LogErr("Link error with port: " + DiscoveryPortS() + " " + err.Error())
+		return
+	}
+	beacon := EncodeBeacon(BeaconAnnounce, r.port, Setting.DeviceName)
+	go func(conn net.PacketConn) {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
 			if err != nil {
-				LogErr(err.Error())
+				if errors.Is(err, net.ErrClosed) {
+					Log("Discovery Responder closed")
+				} else {
+					LogErr("Discovery Responder ReadFrom Error: " + err.Error())
+				}
 				return
 			}
+			kind, _, _, err := DecodeBeacon(buf[:n])
+			if err != nil || kind != BeaconQuery {
+				continue
+			}
+			if _, err = conn.WriteTo(beacon, addr); err != nil {
+				LogErr("Reply beacon error with " + addr.String() + " " + err.Error())
+			}
 		}
+	}(connDiscovery)
+	if !ReceiverAnnounceCheck.Checked {
+		return
+	}
+	stopAnnounce = make(chan struct{})
+	go func(conn net.PacketConn, stop chan struct{}) {
+		Log("Start periodic announce...")
 		for {
+			SendBeacon(conn, beacon, broadcastIps)
 			select {
-			case <-stopBroadcastIp:
-				Log("Stop Broadcast Ip")
+			case <-stop:
+				Log("Stop periodic announce")
 				return
-			default:
-				if sendAllLAN {
-					for _, listIp := range RListItems {
-						addr := listIp + ":" + r.PortS(1)
-						connW, err := net.Dial("udp", addr)
-						if err != nil {
-							LogErr("Link error with " + addr + " " + err.Error())
-							continue
-						}
-						_, err = fmt.Fprintf(connW, "x")
-						if err != nil {
-							LogErr("Link write error with " + addr + " " + err.Error())
-							continue
-						}
-						connW.Close()
-					}
-				} else {
-					addr := RIpInput.Text + ":" + r.PortS(1)
-					connW, err := net.Dial("udp", addr)
-					if err != nil {
-						LogErr("Link error with " + addr + " " + err.Error())
-						time.Sleep(time.Duration(rand.Float32()*100) * time.Millisecond)
-						continue
-					}
-					_, err = fmt.Fprintf(connW, "x")
-					if err != nil {
-						LogErr("Link write error with " + addr + " " + err.Error())
-						continue
-					}
-					connW.Close()
-				}
-				time.Sleep(500 * time.Millisecond)
+			case <-time.After(AnnounceInterval):
 			}
 		}
-	}()
+	}(connDiscovery, stopAnnounce)
+}
+
+// StopDiscoveryResponder 停止回复发现查询与定期通告
+func (r *ReceiveHandler) StopDiscoveryResponder() {
+	if stopAnnounce != nil {
+		close(stopAnnounce)
+		stopAnnounce = nil
+	}
+	if connDiscovery != nil {
+		connDiscovery.Close()
+		connDiscovery = nil
+	}
 }
 func (r *ReceiveHandler) RunReceiverStopSignal() {
 	var err error
-	connStopSignal, err = net.ListenPacket("udp", ":"+r.PortS(2))
+	connStopSignal, err = net.ListenPacket("udp", ":"+r.PortS())
 	if err != nil {
-		LogErr("Link error with port: " + r.PortS(1))
+		LogErr("Link error with port: " + r.PortS())
 		return
 	}
 	go func() {
+		signal := make([]byte, 64)
 		for {
-			_, addr, err := connStopSignal.ReadFrom(make([]byte, 1))
+			n, addr, err := connStopSignal.ReadFrom(signal)
 			if err != nil {
 				if errors.Is(err, net.ErrClosed) {
 					Log("connStopSignal closed")
@@ -271,17 +301,32 @@ func (r *ReceiveHandler) RunReceiverStopSignal() {
 				}
 				return
 			}
-			ip, err := ExtractIPPartOfAddress(addr.String())
+			ip, ok := SenderIP(addr.String())
+			if !ok {
+				LogErr("Stop signal error:unable to find the sender ip", FPeer(addr.String()))
+				continue
+			}
+			//status(1) transferId(16)为暂停或恢复，transferId(16)为停止
+			status := byte(0)
+			data := signal[:n]
+			if n == len(TransferId{})+1 && (data[0] == ReplyPause || data[0] == ReplyResume) {
+				status, data = data[0], data[1:]
+			}
+			id, err := ParseTransferId(data)
 			if err != nil {
-				LogErr("ExtractIPPartOfAddress Error:" + err.Error())
-				return
+				LogErr("Stop signal error:"+err.Error(), FPeer(ip))
+				continue
 			}
-			Log("Stop receiving file with ip:" + ip)
-			if value, ok := ReceivingConnMap.Load(ip); ok {
-				if (*value) != nil {
-					(*value).Close()
+			//只允许发起传输的主机停止或暂停传输
+			if transfer, ok := ActiveTransfers.Load(TransferKey{Direction: DirectionReceived, Id: id}); ok {
+				if peerIp, _ := SenderIP(transfer.Peer); peerIp == ip {
+					if status != 0 {
+						transfer.SetPeerPaused(status == ReplyPause)
+						continue
+					}
+					Log("Stop receiving file", FPeer(ip), F("id", id))
+					transfer.Cancel()
 				}
-				ReceivingConnMap.Delete(ip)
 			}
 		}
 	}()
@@ -295,15 +340,15 @@ func (r *ReceiveHandler) StopReceiverStopSignal() {
 // RunReceiveFile 启动等待接收文件
 func (r *ReceiveHandler) RunReceiveFile() {
 	Log("Start listening to receive files...")
-	logCloseOrErr := func(err error, errMsg string) {
+	logCloseOrErr := func(err error, errMsg string, fields ...Field) {
 		if errors.Is(err, net.ErrClosed) {
-			Log(errMsg + " runReceiveFile Accept closed:" + err.Error())
+			Log(errMsg+" runReceiveFile Accept closed:"+err.Error(), fields...)
 		} else {
-			LogErr(errMsg + err.Error())
+			LogErr(errMsg+err.Error(), fields...)
 		}
 	}
 	var err error
-	listener, err = net.Listen("tcp", ":"+r.PortS(0))
+	listener, err = net.Listen("tcp", ":"+r.PortS())
 	if err != nil {
 		LogErr("runReceiveFile Listen fail:" + err.Error())
 		return
@@ -317,24 +362,161 @@ func (r *ReceiveHandler) RunReceiveFile() {
 				logCloseOrErr(err, "runReceiveFile Accept stop:")
 				break
 			}
-			Log("Start receiving files from:" + conn.RemoteAddr().String())
+			if ok, reason := AccessAllowed(conn.RemoteAddr().String()); !ok {
+				LogWarn("Blocked connection:"+reason, FPeer(conn.RemoteAddr().String()))
+				conn.Close()
+				continue
+			}
+			Log("Start receiving files", FPeer(conn.RemoteAddr().String()))
 			go func(conn net.Conn) {
-				address, _ := ExtractIPPartOfAddress(conn.RemoteAddr().String())
-				ReceivingConnMap.Store(address, &conn)
+				address, _, err2 := net.SplitHostPort(conn.RemoteAddr().String())
+				if err2 != nil {
+					address = conn.RemoteAddr().String()
+				}
 				defer conn.Close()
-				defer ReceivingConnMap.Delete(address)
-				//设置超时时间
-				//err2 := conn.SetReadDeadline(time.Now().Add(time.Second))
-				//if err2 != nil {
-				//	logCloseOrErr(err2, "set time deadline error:")
-				//}
-
-				err2 := ReceiveFile(r.fileSrc, conn, pbHook)
+				//传输头与回复需在握手超时内完成，之后按空闲超时计时
+				if err2 := SetHandshakeDeadline(conn); err2 != nil {
+					logCloseOrErr(err2, "set handshake deadline error:", FPeer(address))
+					return
+				}
+				header, err2 := ReadHeader(conn)
+				err2 = timeoutErr(err2)
+				if errors.Is(err2, io.EOF) {
+					//没有发送任何数据就关闭的连接，如定时发送检查接收端是否上线
+					LogDebug("Connection closed before header", FPeer(address))
+					return
+				}
 				if err2 != nil {
-					logCloseOrErr(err2, "receive file ended:")
+					logCloseOrErr(err2, "receive header error:", FPeer(address))
+					return
+				}
+				//文件在回复前先读取文件名与大小，用于检查大小限制与剩余空间
+				var fileHeader FileHeader
+				if header.Kind == KindFile {
+					if fileHeader, err2 = ReadFileHeader(conn); err2 != nil {
+						logCloseOrErr(timeoutErr(err2), "receive file header error:", FPeer(address))
+						return
+					}
+				}
+				reject := func(reason string) {
+					LogWarn("Reject sender:"+reason, FPeer(address), F("device", header.DeviceName))
+					if err := WriteReply(conn, Reply{Status: ReplyReject, Reason: reason}); err != nil {
+						LogErr(err.Error(), FPeer(address))
+					}
+				}
+				if !CheckPairingToken(header.Token) {
+					reject("wrong pairing token")
+					return
+				}
+				if header.Kind != KindFile && header.Kind != KindText && header.Kind != KindMirror {
+					reject("unsupported transfer kind")
+					return
+				}
+				if wasCanceled(header.Id) {
+					reject("canceled by receiver")
+					return
+				}
+				//同一id同时只接受一个连接，发送端超时重连时旧连接可能还没有超时，发送端会稍后重试
+				if !claimReceive(header.Id) {
+					reject(RejectStillRunning)
+					return
+				}
+				defer releaseReceive(header.Id)
+				//同一传输id重连时从已接收的字节续传
+				partial, resume := takePartial(header.Id)
+				if resume && (partial.Name != fileHeader.Name || partial.Size != fileHeader.Size) {
+					LogWarn("Discard partial file that does not match the resumed file", FFile(partial.Path))
+					os.Remove(partial.Path)
+					partial, resume = nil, false
+				}
+				reply := Reply{Status: ReplyAccept}
+				if resume {
+					reply.Offset = partial.Written
+				}
+				need := fileHeader.Size - reply.Offset
+				if header.Kind == KindFile {
+					if reason := ReserveReceive(r.fileSrc, fileHeader.Size, need); reason != "" {
+						if resume {
+							keepPartial(header.Id, partial)
+						}
+						reject(reason)
+						return
+					}
+				}
+				if err2 = WriteReply(conn, reply); err2 != nil {
+					logCloseOrErr(timeoutErr(err2), "send reply error:", FPeer(address))
+					FinishReceive(need, need)
+					if resume {
+						keepPartial(header.Id, partial)
+					}
+					return
+				}
+				conn = NewIdleConn(conn)
+				switch header.Kind {
+				case KindText:
+					r.ReceiveText(conn, header, address)
+					return
+				case KindMirror:
+					Notify("Incoming folder mirror", "From "+header.DeviceName+"("+address+")")
+					r.ReceiveMirror(conn, header, address, pbHook)
+					return
+				}
+				transfer := NewTransfer(header.Id, DirectionReceived, conn.RemoteAddr().String(), header.DeviceName, conn)
+				defer transfer.Done()
+				transfer.SetPauseReply()
+				startTime := time.Now()
+				peer := address
+				if header.DeviceName != "" {
+					peer = header.DeviceName + "(" + address + ")"
+				}
+				if resume {
+					Log("Resume receiving file", FPeer(address), FFile(partial.Name), F("offset", partial.Written))
+				} else {
+					Notify("Incoming file", fileHeader.Name+" ("+FormatByteSize(fileHeader.Size, 1)+") from "+peer)
+				}
+				result, err2 := ReceiveFile(r.fileSrc, conn, fileHeader, pbHook, transfer, partial)
+				if err2 != nil {
+					FinishReceive(need, fileHeader.Size-transfer.now.Load())
+				} else {
+					FinishReceive(need, 0)
+					RunReceiveHooks(result, header.DeviceName, address)
+				}
+				if result.Name != "" {
+					RecordTransfer(DirectionReceived, address, result, startTime, err2)
+				}
+				if err2 != nil {
+					logCloseOrErr(err2, "receive file ended:", FPeer(address), FFile(result.Name))
+				}
+				//确认已完整接收，保留了未接收完的文件时不回复，等待发送端重连续传
+				done := Reply{Status: ReplyAccept, Offset: result.Size}
+				if err2 != nil {
+					done = Reply{Status: ReplyReject, Reason: err2.Error()}
+				}
+				if _, kept := partialFiles.Load(header.Id); !kept && !transfer.Canceled() {
+					NotifyTransfer(DirectionReceived, peer, result, err2)
+					if err3 := WriteReply(conn, done); err3 != nil {
+						LogDebug("Send receive result error:"+err3.Error(), FPeer(address))
+					}
 				}
 			}(conn)
 		}
 		pbHook.Close()
 	}()
 }
+
+// ReceiveText 接收文本消息，显示到消息页并通知
+func (r *ReceiveHandler) ReceiveText(conn net.Conn, header Header, address string) {
+	startTime := time.Now()
+	text, err := ReadText(conn)
+	peer := address
+	if header.DeviceName != "" {
+		peer = header.DeviceName + "(" + address + ")"
+	}
+	RecordMessage(DirectionReceived, peer, text, startTime, err)
+	if err != nil {
+		LogErr("Receive text error:"+err.Error(), FPeer(peer))
+		return
+	}
+	Log("Received text", FPeer(peer), FBytes(int64(len(text))))
+	Notify("Message from "+peer, text)
+}
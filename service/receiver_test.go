@@ -0,0 +1,52 @@
+package service
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestStopSignalIPv6 ipv6发送端的暂停与停止信号按ip匹配到接收中的传输
+func TestStopSignalIPv6(t *testing.T) {
+	probe, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback is not available:", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+	handler := &ReceiveHandler{port: uint16(port)}
+	handler.RunReceiverStopSignal()
+	defer handler.StopReceiverStopSignal()
+
+	transfer := NewTransfer(NewTransferId(), DirectionReceived, "[::1]:50000", "pc", nil)
+	defer transfer.Done()
+	other := NewTransfer(NewTransferId(), DirectionReceived, "[::2]:50000", "pc", nil)
+	defer other.Done()
+	address := net.JoinHostPort("::1", strconv.Itoa(port))
+
+	SendPauseSignal(address, transfer.Id, true)
+	waitFor(t, "pause", func() bool {
+		transfer.lock.Lock()
+		defer transfer.lock.Unlock()
+		return transfer.peerPaused
+	})
+	//只有发起传输的主机可以停止
+	SendStopSignal(address, other.Id)
+	SendStopSignal(address, transfer.Id)
+	waitFor(t, "stop", transfer.Canceled)
+	if other.Canceled() {
+		t.Error("transfer from another host was stopped")
+	}
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
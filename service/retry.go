@@ -0,0 +1,165 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// 发送失败后的重试间隔从RetryDelayMin开始翻倍，最长RetryDelayMax
+const (
+	RetryDelayMin = time.Second
+	RetryDelayMax = 30 * time.Second
+)
+
+// BackoffDelay 第attempt次失败后的等待时间，按指数增长并加入随机抖动，避免多个发送端同时重连
+func BackoffDelay(attempt int, min, max time.Duration) time.Duration {
+	delay := min
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	//在delay的50%~100%之间随机
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// RejectStillRunning 重连时接收端上相同id的旧连接还没有结束，可以稍后重试
+const RejectStillRunning = "transfer is still running on receiver"
+
+// retryable 连接失败、中断或同时发送时落后太多可以重试，取消与被接收端拒绝时不重试
+func retryable(err error, transfer *Transfer) bool {
+	if err == nil || transfer.Canceled() {
+		return false
+	}
+	if errors.Is(err, ErrFellBehind) {
+		return true
+	}
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		return rejected.Reason == RejectStillRunning
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// dialTransfer 连接接收端并发送传输头与文件名大小(file不为空时)，返回接收端确认的续传位置，之后的读写按空闲超时计时
+func dialTransfer(peer Peer, header Header, file *FileHeader) (net.Conn, Reply, error) {
+	conn, err := DialTCP(peer.Address())
+	if err != nil {
+		return nil, Reply{}, err
+	}
+	if err = SetHandshakeDeadline(conn); err != nil {
+		conn.Close()
+		return nil, Reply{}, err
+	}
+	if err = WriteHeader(conn, header); err != nil {
+		conn.Close()
+		return nil, Reply{}, timeoutErr(err)
+	}
+	if file != nil {
+		if err = WriteFileHeader(conn, *file); err != nil {
+			conn.Close()
+			return nil, Reply{}, timeoutErr(err)
+		}
+	}
+	reply, err := ReadReply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, reply, timeoutErr(err)
+	}
+	return NewIdleConn(conn), reply, nil
+}
+
+// replyWatcher 发送文件内容期间在后台读取接收端的回复，处理接收端的暂停、恢复与进度，最后一个回复为校验结果
+type replyWatcher struct {
+	idle    *IdleConn
+	final   chan replyResult
+	changed chan struct{}
+}
+
+type replyResult struct {
+	reply Reply
+	err   error
+}
+
+// watchReplies 开始读取conn上接收端的回复，conn关闭后后台的读取随之结束
+func watchReplies(conn net.Conn, transfer *Transfer) *replyWatcher {
+	w := &replyWatcher{final: make(chan replyResult, 1), changed: make(chan struct{}, 1)}
+	w.idle, _ = conn.(*IdleConn)
+	reader := io.Reader(conn)
+	if w.idle != nil {
+		//内容发送期间接收端只会发送暂停通知与进度，不能按空闲超时读取
+		reader = w.idle.Conn
+	}
+	go func() {
+		for {
+			reply, err := ReadContentReply(reader)
+			if err == nil && (reply.Status == ReplyPause || reply.Status == ReplyResume || reply.Status == ReplyProgress) {
+				if reply.Status != ReplyProgress {
+					transfer.SetPeerPaused(reply.Status == ReplyPause)
+				}
+				select {
+				case w.changed <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			w.final <- replyResult{reply: reply, err: err}
+			return
+		}
+	}()
+	return w
+}
+
+// Final 内容发送完后等待接收端的校验结果，超过空闲超时没有任何回复时返回ErrTimedOut，接收端暂停期间不计时
+// 发送的内容可能仍在缓冲区中等待接收端读取，收到进度回复时重新计时
+func (w *replyWatcher) Final() (Reply, error) {
+	for {
+		var timeout <-chan time.Time
+		if w.idle != nil && w.idle.timeout > 0 && !w.idle.Suspended() {
+			timeout = time.After(w.idle.timeout)
+		}
+		select {
+		case result := <-w.final:
+			return result.reply, timeoutErr(result.err)
+		case <-w.changed:
+		case <-timeout:
+			//让后台阻塞的读取以超时返回
+			w.idle.Conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// retrySendFile 按Setting.RetryCount重试发送给单个接收端，使用相同的传输id以便接收端续传
+func retrySendFile(src string, fileHeader FileHeader, peer Peer, transfer *Transfer, err error) (FileResult, error) {
+	var result FileResult
+	address := peer.Address()
+	for attempt := 2; attempt <= Setting.RetryCount+1 && retryable(err, transfer); attempt++ {
+		delay := BackoffDelay(attempt-1, RetryDelayMin, RetryDelayMax)
+		LogWarn("Send failed, retry:"+err.Error(), FPeer(address), FFile(src), F("attempt", attempt), F("delay", delay.Round(time.Millisecond).String()))
+		if !transfer.WaitRetry(attempt, delay) {
+			return result, net.ErrClosed
+		}
+		header := Header{Kind: KindFile, Id: transfer.Id, DeviceName: Setting.DeviceName, Token: peer.Token}
+		var conn net.Conn
+		var reply Reply
+		conn, reply, err = dialTransfer(peer, header, &fileHeader)
+		if err != nil {
+			continue
+		}
+		transfer.SetConn(conn)
+		watcher := watchReplies(conn, transfer)
+		writer := io.MultiWriter(conn, transfer)
+		result, err = SendFile(src, writer, fileHeader, reply.Offset, transfer)
+		if err == nil {
+			_, err = watcher.Final()
+		}
+		conn.Close()
+	}
+	return result, err
+}
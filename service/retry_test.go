@@ -0,0 +1,130 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/test"
+	"fyne.io/fyne/v2/widget"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// cutWriter 写出limit个字节后关闭连接，模拟传输中途断开，limit小于0时不断开
+type cutWriter struct {
+	conn    net.Conn
+	limit   int64
+	written int64
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if w.limit >= 0 && w.written+int64(len(p)) > w.limit {
+		n, _ := w.conn.Write(p[:w.limit-w.written])
+		w.written += int64(n)
+		w.conn.Close()
+		return n, io.ErrClosedPipe
+	}
+	n, err := w.conn.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+type attemptResult struct {
+	offset   int64
+	sent     int64
+	sendErr  error
+	received FileResult
+	recvErr  error
+}
+
+// resumeAttempt 在net.Pipe上按协议完成一次尝试：接收端回复已确认的字节数，发送端从该位置继续发送，cut为发送端断开前写出的字节数
+func resumeAttempt(src, dir string, fileHeader FileHeader, id TransferId, cut int64) attemptResult {
+	senderConn, receiverConn := net.Pipe()
+	var result attemptResult
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer receiverConn.Close()
+		partial, _ := takePartial(id)
+		reply := Reply{Status: ReplyAccept}
+		if partial != nil {
+			reply.Offset = partial.Written
+		}
+		if result.recvErr = WriteReply(receiverConn, reply); result.recvErr != nil {
+			return
+		}
+		pbHook := NewMultipleProgressBarHook(widget.NewProgressBar(), canvas.NewText("", nil))
+		defer pbHook.Close()
+		transfer := NewTransfer(id, DirectionReceived, "127.0.0.1:1", "pc", receiverConn)
+		defer transfer.Done()
+		result.received, result.recvErr = ReceiveFile(dir, receiverConn, fileHeader, pbHook, transfer, partial)
+	}()
+	reply, err := ReadReply(senderConn)
+	if err != nil {
+		result.sendErr = err
+	} else {
+		result.offset = reply.Offset
+		transfer := NewTransfer(id, DirectionSent, "127.0.0.1:2", "pc", senderConn)
+		writer := &cutWriter{conn: senderConn, limit: cut}
+		_, result.sendErr = SendFile(src, writer, fileHeader, reply.Offset, transfer)
+		result.sent = writer.written
+		transfer.Done()
+	}
+	senderConn.Close()
+	<-done
+	return result
+}
+
+func TestResumeAfterDisconnect(t *testing.T) {
+	test.NewApp()
+	//SendFile显示在发送页的进度条上
+	if SenderProgressBar == nil {
+		SenderProgressBar, SenderSpeedText = widget.NewProgressBar(), canvas.NewText("", nil)
+	}
+	dir := t.TempDir()
+	content := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	src := filepath.Join(dir, "video.mp4")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	recvDir := filepath.Join(dir, "recv")
+	os.MkdirAll(recvDir, 0755)
+	fileHeader, err := StatSendFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := NewTransferId()
+	const cut = 1<<20 + 123
+	first := resumeAttempt(src, recvDir, fileHeader, id, cut)
+	if first.sendErr == nil || first.recvErr == nil {
+		t.Fatalf("first attempt: send %v receive %v", first.sendErr, first.recvErr)
+	}
+	second := resumeAttempt(src, recvDir, fileHeader, id, -1)
+	if second.sendErr != nil || second.recvErr != nil {
+		t.Fatalf("retry: send %v receive %v", second.sendErr, second.recvErr)
+	}
+	//接收端确认的是第一次实际收到的字节数，重试只发送剩余部分与md5
+	if second.offset != cut {
+		t.Errorf("resumed at %d, want %d", second.offset, cut)
+	}
+	if want := int64(len(content)) - cut + md5.Size; second.sent != want {
+		t.Errorf("retry sent %d bytes, want %d", second.sent, want)
+	}
+	got, err := os.ReadFile(second.received.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(content)
+	if !bytes.Equal(got, content) || second.received.MD5 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("received file differs, md5 %s", second.received.MD5)
+	}
+	if filepath.Base(second.received.Path) != "video.mp4" {
+		t.Errorf("resumed into %s", second.received.Path)
+	}
+}
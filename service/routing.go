@@ -0,0 +1,181 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// routeLock 保护Setting.Routes，界面修改规则时接收中的文件可能正在匹配
+var routeLock sync.RWMutex
+
+// 路由规则的匹配方式
+const (
+	RouteAny    = "Any file"
+	RouteDevice = "Sender device"
+	RouteName   = "File name"
+)
+
+// RouteRule 按发送端设备名或文件名把接收的文件保存到下载路径下的子文件夹
+// Pattern为逗号分隔的通配符，如*.jpg,*.png，Folder中可以使用{device}、{date}、{ext}
+type RouteRule struct {
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+	Folder  string `json:"folder"`
+}
+
+// Text 列表中显示的文本
+func (r RouteRule) Text() string {
+	if r.Match == RouteAny {
+		return r.Match + " -> " + r.Folder
+	}
+	return r.Match + " " + r.Pattern + " -> " + r.Folder
+}
+
+// Matches 文件是否符合规则，通配符不区分大小写
+func (r RouteRule) Matches(name, device string) bool {
+	target := name
+	switch r.Match {
+	case RouteAny:
+		return true
+	case RouteDevice:
+		target = device
+	case RouteName:
+	default:
+		return false
+	}
+	target = strings.ToLower(target)
+	for _, pattern := range strings.Split(r.Pattern, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if ok, _ := filepath.Match(pattern, target); ok && pattern != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// routeFolder 替换Folder中的变量，返回相对下载路径的子文件夹
+func (r RouteRule) routeFolder(name, device string, now time.Time) (string, error) {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	if ext == "" {
+		ext = "other"
+	}
+	folder := strings.NewReplacer(
+		"{device}", safeFolderName(device),
+		"{date}", now.Format("2006-01-02"),
+		"{ext}", safeFolderName(ext),
+	).Replace(r.Folder)
+	//两种分隔符在各系统上都表示子文件夹，不允许盘符，同一规则在各系统上含义相同
+	folder = filepath.Clean(filepath.FromSlash(strings.ReplaceAll(folder, `\`, "/")))
+	if strings.Contains(folder, ":") || !filepath.IsLocal(folder) {
+		return "", errors.New("illegal route folder:" + r.Folder)
+	}
+	return folder, nil
+}
+
+// safeFolderName 设备名等作为文件夹名时去掉路径分隔符等字符
+func safeFolderName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < 32 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(s))
+	if s == "" || s == "." || s == ".." {
+		return "unknown"
+	}
+	return s
+}
+
+// ValidateRouteRule 检查规则的匹配方式、通配符与文件夹
+func ValidateRouteRule(rule RouteRule) error {
+	switch rule.Match {
+	case RouteAny:
+	case RouteDevice, RouteName:
+		if strings.TrimSpace(rule.Pattern) == "" {
+			return errors.New("route pattern is empty")
+		}
+		for _, pattern := range strings.Split(rule.Pattern, ",") {
+			if _, err := filepath.Match(strings.TrimSpace(pattern), ""); err != nil {
+				return errors.New("illegal route pattern:" + pattern)
+			}
+		}
+	default:
+		return errors.New("unknown route match:" + rule.Match)
+	}
+	if strings.TrimSpace(rule.Folder) == "" {
+		return errors.New("route folder is empty")
+	}
+	_, err := rule.routeFolder("a.txt", "device", time.Now())
+	return err
+}
+
+// RouteDir 按Setting.Routes中第一条匹配的规则得到保存文件的文件夹，没有匹配时为dir，文件夹不存在时创建
+func RouteDir(dir, name, device string) (string, error) {
+	routeLock.RLock()
+	routes := Setting.Routes
+	routeLock.RUnlock()
+	for _, rule := range routes {
+		if !rule.Matches(name, device) {
+			continue
+		}
+		folder, err := rule.routeFolder(name, device, time.Now())
+		if err != nil {
+			return dir, err
+		}
+		routed := filepath.Join(dir, folder)
+		if err = os.MkdirAll(routed, 0755); err != nil {
+			return dir, err
+		}
+		LogDebug("Route received file", FFile(name), F("device", device), F("folder", folder))
+		return routed, nil
+	}
+	return dir, nil
+}
+
+// AddRouteRule 在最后新增规则
+func AddRouteRule(rule RouteRule) error {
+	if err := ValidateRouteRule(rule); err != nil {
+		return err
+	}
+	routeLock.Lock()
+	Setting.Routes = append(append([]RouteRule{}, Setting.Routes...), rule)
+	routeLock.Unlock()
+	SaveConfig()
+	Log("Add route rule", F("rule", rule.Text()))
+	RefreshRouteList()
+	return nil
+}
+
+// RemoveRouteRule 删除第i条规则
+func RemoveRouteRule(i int) {
+	routeLock.Lock()
+	if i < 0 || i >= len(Setting.Routes) {
+		routeLock.Unlock()
+		return
+	}
+	rule := Setting.Routes[i]
+	Setting.Routes = append(append([]RouteRule{}, Setting.Routes[:i]...), Setting.Routes[i+1:]...)
+	routeLock.Unlock()
+	SaveConfig()
+	Log("Remove route rule", F("rule", rule.Text()))
+	RefreshRouteList()
+}
+
+// MoveRouteRuleUp 把第i条规则上移，靠前的规则优先匹配
+func MoveRouteRuleUp(i int) {
+	routeLock.Lock()
+	if i <= 0 || i >= len(Setting.Routes) {
+		routeLock.Unlock()
+		return
+	}
+	routes := append([]RouteRule{}, Setting.Routes...)
+	routes[i-1], routes[i] = routes[i], routes[i-1]
+	Setting.Routes = routes
+	routeLock.Unlock()
+	SaveConfig()
+	RefreshRouteList()
+}
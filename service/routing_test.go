@@ -0,0 +1,126 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRouteFolder(t *testing.T) {
+	now := time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local)
+	for _, c := range []struct {
+		folder, name, device string
+		want                 string //为空时应当返回错误
+	}{
+		{"photos", "a.jpg", "pc", "photos"},
+		{"{device}/{date}", "a.jpg", "pc", "pc/2024-05-06"},
+		{"by-type/{ext}", "a.JPG", "pc", "by-type/jpg"},
+		{"by-type/{ext}", "README", "pc", "by-type/other"},
+		{`a\b`, "a.jpg", "pc", "a/b"},
+		{"a/../b", "a.jpg", "pc", "b"},
+		{"{device}", "a.jpg", "../x", ".._x"},
+		{"{device}", "a.jpg", "..", "unknown"},
+		{"{device}", "a.jpg", "", "unknown"},
+		{"{device}", "a.jpg", `C:\x`, "C__x"},
+		{"..", "a.jpg", "pc", ""},
+		{"a/../..", "a.jpg", "pc", ""},
+		{`a\..\..`, "a.jpg", "pc", ""},
+		{"/etc", "a.jpg", "pc", ""},
+		{`C:\x`, "a.jpg", "pc", ""},
+		{"C:x", "a.jpg", "pc", ""},
+		{`\\server\share`, "a.jpg", "pc", ""},
+	} {
+		got, err := RouteRule{Match: RouteAny, Folder: c.folder}.routeFolder(c.name, c.device, now)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("folder %q device %q: got %q, want error", c.folder, c.device, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(c.want) {
+			t.Errorf("folder %q device %q: got %q %v, want %q", c.folder, c.device, got, err, c.want)
+		}
+	}
+}
+
+func TestSafeFolderName(t *testing.T) {
+	for _, c := range []struct{ name, want string }{
+		{"pc", "pc"},
+		{" pc ", "pc"},
+		{"", "unknown"},
+		{"  ", "unknown"},
+		{".", "unknown"},
+		{"..", "unknown"},
+		{"../x", ".._x"},
+		{`a/b\c:d`, "a_b_c_d"},
+		{"a\x00b", "a_b"},
+	} {
+		if got := safeFolderName(c.name); got != c.want {
+			t.Errorf("safeFolderName(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestValidateRouteRule(t *testing.T) {
+	for _, c := range []struct {
+		rule RouteRule
+		ok   bool
+	}{
+		{RouteRule{Match: RouteAny, Folder: "all"}, true},
+		{RouteRule{Match: RouteName, Pattern: "*.jpg, *.png", Folder: "photos"}, true},
+		{RouteRule{Match: RouteDevice, Pattern: "phone*", Folder: "{device}"}, true},
+		{RouteRule{Match: RouteAny, Folder: ""}, false},
+		{RouteRule{Match: RouteAny, Folder: "  "}, false},
+		{RouteRule{Match: RouteName, Pattern: "", Folder: "photos"}, false},
+		{RouteRule{Match: RouteName, Pattern: "[", Folder: "photos"}, false},
+		{RouteRule{Match: "Size", Pattern: "*", Folder: "photos"}, false},
+		{RouteRule{Match: RouteAny, Folder: ".."}, false},
+		{RouteRule{Match: RouteAny, Folder: `C:\x`}, false},
+	} {
+		if err := ValidateRouteRule(c.rule); (err == nil) != c.ok {
+			t.Errorf("ValidateRouteRule(%s) = %v", c.rule.Text(), err)
+		}
+	}
+}
+
+func TestRouteRuleMatches(t *testing.T) {
+	rule := RouteRule{Match: RouteName, Pattern: "*.jpg, *.PNG"}
+	for name, want := range map[string]bool{"a.jpg": true, "A.JPG": true, "b.png": true, "c.gif": false} {
+		if got := rule.Matches(name, "pc"); got != want {
+			t.Errorf("Matches(%q) = %v", name, got)
+		}
+	}
+	if !(RouteRule{Match: RouteDevice, Pattern: "phone*"}).Matches("a.txt", "Phone-1") {
+		t.Error("device pattern should match case insensitively")
+	}
+}
+
+func TestRouteRulesConcurrent(t *testing.T) {
+	saved := Setting.Routes
+	defer func() { Setting.Routes = saved }()
+	Setting.Routes = nil
+	dir := t.TempDir()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := AddRouteRule(RouteRule{Match: RouteName, Pattern: "*.none", Folder: "none"}); err != nil {
+				t.Error(err)
+				return
+			}
+			AddRouteRule(RouteRule{Match: RouteAny, Folder: "all"})
+			MoveRouteRuleUp(1)
+			RemoveRouteRule(1)
+			RemoveRouteRule(0)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := RouteDir(dir, "a.txt", "pc"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if len(Setting.Routes) != 0 {
+		t.Errorf("routes left: %v", Setting.Routes)
+	}
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduledJob 定时或等待接收端上线后发送的文件
+type ScheduledJob struct {
+	Id         string    `json:"id"`
+	Path       string    `json:"path"`
+	Target     string    `json:"target"`
+	At         time.Time `json:"at"`
+	WhenOnline bool      `json:"whenOnline"`
+	Attempts   int       `json:"attempts"`
+	NextRun    time.Time `json:"nextRun"`
+	LastError  string    `json:"lastError,omitempty"`
+	// Failed 重试次数用完后不再执行，保留在列表中等待删除
+	Failed bool `json:"failed,omitempty"`
+
+	running bool
+}
+
+// ScheduleCheckInterval 检查到期任务的间隔
+const ScheduleCheckInterval = 5 * time.Second
+
+// ScheduleOnlinePoll 等待上线的任务连接失败后再次尝试的间隔
+const ScheduleOnlinePoll = 30 * time.Second
+
+// ScheduleProbeTimeout 检查接收端是否上线的连接超时
+const ScheduleProbeTimeout = 3 * time.Second
+
+// 定时任务连接失败后的重试间隔从ScheduleRetryMin开始翻倍，最长ScheduleRetryMax，最多ScheduleMaxAttempts次
+const (
+	ScheduleRetryMin    = 30 * time.Second
+	ScheduleRetryMax    = 30 * time.Minute
+	ScheduleMaxAttempts = 10
+)
+
+var ScheduledJobs []*ScheduledJob
+var scheduleLock sync.Mutex
+
+// Text 列表中显示的文本，需在ListScheduledJobs得到的副本上调用
+func (j ScheduledJob) Text() string {
+	builder := strings.Builder{}
+	builder.WriteString(filepath.Base(j.Path))
+	builder.WriteString(" -> ")
+	builder.WriteString(j.Target)
+	switch {
+	case j.running:
+		builder.WriteString(" running")
+	case j.Failed:
+		builder.WriteString(" failed")
+	case j.WhenOnline && j.Attempts == 0:
+		builder.WriteString(" when online, next:")
+		builder.WriteString(j.NextRun.Format("2006-01-02 15:04:05"))
+	default:
+		builder.WriteString(" next:")
+		builder.WriteString(j.NextRun.Format("2006-01-02 15:04:05"))
+	}
+	if j.Attempts > 0 {
+		builder.WriteString(" attempts:")
+		builder.WriteString(strconv.Itoa(j.Attempts))
+	}
+	if j.LastError != "" {
+		builder.WriteString(" error:")
+		builder.WriteString(j.LastError)
+	}
+	return builder.String()
+}
+
+func schedulePath() (string, error) {
+	return ConfigFile("schedule.json")
+}
+
+// LoadSchedule 读取保存的任务
+func LoadSchedule() {
+	path, err := schedulePath()
+	if err != nil {
+		LogErr("Load schedule error:" + err.Error())
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			LogErr("Load schedule error:" + err.Error())
+		}
+		return
+	}
+	scheduleLock.Lock()
+	err = json.Unmarshal(data, &ScheduledJobs)
+	scheduleLock.Unlock()
+	if err != nil {
+		LogErr("Load schedule error:" + err.Error())
+		return
+	}
+	Log("Load schedule:" + strconv.Itoa(len(ScheduledJobs)))
+	RefreshScheduleList()
+}
+
+// saveSchedule 保存任务，调用时需持有scheduleLock
+func saveSchedule() {
+	path, err := schedulePath()
+	if err != nil {
+		LogErr("Save schedule error:" + err.Error())
+		return
+	}
+	data, err := json.MarshalIndent(ScheduledJobs, "", "  ")
+	if err != nil {
+		LogErr("Save schedule error:" + err.Error())
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		LogErr("Save schedule error:" + err.Error())
+		return
+	}
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		LogErr("Save schedule error:" + err.Error())
+	}
+}
+
+// AddScheduledJob 新增任务，whenOnline为true时忽略at，立即开始等待接收端上线
+func AddScheduledJob(path, target string, at time.Time, whenOnline bool) error {
+	if stat, err := os.Stat(path); err != nil {
+		return err
+	} else if stat.IsDir() {
+		return errors.New("file path is not a file")
+	}
+	if _, err := ParseTarget(target); err != nil {
+		return errors.Join(errors.New("target is illegal"), err)
+	}
+	job := &ScheduledJob{
+		Id:         NewTransferId().String(),
+		Path:       path,
+		Target:     target,
+		At:         at,
+		WhenOnline: whenOnline,
+		NextRun:    at,
+	}
+	if whenOnline {
+		job.At = time.Time{}
+		job.NextRun = time.Now()
+	}
+	scheduleLock.Lock()
+	ScheduledJobs = append(ScheduledJobs, job)
+	saveSchedule()
+	scheduleLock.Unlock()
+	Log("Schedule send", FFile(path), F("target", target), F("next", job.NextRun.Format("2006-01-02 15:04:05")), F("whenOnline", whenOnline))
+	RefreshScheduleList()
+	return nil
+}
+
+// RemoveScheduledJob 删除任务，正在执行的发送不受影响
+func RemoveScheduledJob(id string) {
+	scheduleLock.Lock()
+	for i, job := range ScheduledJobs {
+		if job.Id == id {
+			ScheduledJobs = append(ScheduledJobs[:i], ScheduledJobs[i+1:]...)
+			saveSchedule()
+			Log("Remove scheduled send", FFile(job.Path), F("target", job.Target))
+			break
+		}
+	}
+	scheduleLock.Unlock()
+	RefreshScheduleList()
+}
+
+// RunScheduledJobNow 立即执行任务，失败的任务重新开始计数
+func RunScheduledJobNow(id string) {
+	scheduleLock.Lock()
+	for _, job := range ScheduledJobs {
+		if job.Id == id && !job.running {
+			job.NextRun = time.Now()
+			job.Failed = false
+			job.Attempts = 0
+		}
+	}
+	scheduleLock.Unlock()
+	runDueJobs()
+}
+
+// ListScheduledJobs 按下次执行时间排序的任务副本，执行中的任务会在后台修改状态
+func ListScheduledJobs() []ScheduledJob {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+	list := make([]ScheduledJob, len(ScheduledJobs))
+	for i, job := range ScheduledJobs {
+		list[i] = *job
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].NextRun.Before(list[j].NextRun)
+	})
+	return list
+}
+
+// RunScheduler 定时检查并执行到期的任务
+func RunScheduler() {
+	go func() {
+		ticker := time.NewTicker(ScheduleCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runDueJobs()
+		}
+	}()
+}
+
+func runDueJobs() {
+	now := time.Now()
+	scheduleLock.Lock()
+	due := make([]*ScheduledJob, 0)
+	for _, job := range ScheduledJobs {
+		if !job.running && !job.Failed && !job.NextRun.After(now) {
+			job.running = true
+			due = append(due, job)
+		}
+	}
+	scheduleLock.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	RefreshScheduleList()
+	for _, job := range due {
+		go runScheduledJob(job)
+	}
+}
+
+func runScheduledJob(job *ScheduledJob) {
+	peer, err := ParseTarget(job.Target)
+	if err == nil && job.WhenOnline {
+		err = probePeer(peer)
+	}
+	if err == nil {
+		Log("Run scheduled send", FFile(job.Path), FPeer(peer.Address()))
+		err = SendToPeers(job.Path, []Peer{peer}, OriginSchedule)[0]
+	}
+	scheduleLock.Lock()
+	job.running = false
+	if err == nil {
+		for i, item := range ScheduledJobs {
+			if item == job {
+				ScheduledJobs = append(ScheduledJobs[:i], ScheduledJobs[i+1:]...)
+				break
+			}
+		}
+		Log("Scheduled send finished", FFile(job.Path), F("target", job.Target))
+	} else if job.WhenOnline && isDialError(err) {
+		//接收端未上线不计入重试次数
+		job.NextRun = time.Now().Add(ScheduleOnlinePoll)
+	} else {
+		job.Attempts++
+		job.LastError = err.Error()
+		if job.Attempts >= ScheduleMaxAttempts {
+			job.Failed = true
+			LogErr("Scheduled send failed:"+err.Error(), FFile(job.Path), F("target", job.Target), F("attempts", job.Attempts))
+		} else {
+			job.NextRun = time.Now().Add(scheduleRetryDelay(job.Attempts))
+			LogWarn("Scheduled send will retry:"+err.Error(), FFile(job.Path), F("target", job.Target), F("next", job.NextRun.Format("2006-01-02 15:04:05")))
+		}
+	}
+	saveSchedule()
+	scheduleLock.Unlock()
+	RefreshScheduleList()
+}
+
+// scheduleRetryDelay 第attempts次失败后的等待时间
+func scheduleRetryDelay(attempts int) time.Duration {
+	return BackoffDelay(attempts, ScheduleRetryMin, ScheduleRetryMax)
+}
+
+// probePeer 连接后立即关闭以检查接收端是否上线，不产生传输记录
+func probePeer(peer Peer) error {
+	conn, err := net.DialTimeout("tcp", peer.Address(), ScheduleProbeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// isDialError 是否为建立连接时的错误
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListScheduledJobsSnapshot(t *testing.T) {
+	saved := ScheduledJobs
+	defer func() { ScheduledJobs = saved }()
+	now := time.Now()
+	later := &ScheduledJob{Id: "b", Path: "/tmp/b.txt", Target: "pc", NextRun: now.Add(time.Hour)}
+	sooner := &ScheduledJob{Id: "a", Path: "/tmp/a.txt", Target: "pc", NextRun: now}
+	ScheduledJobs = []*ScheduledJob{later, sooner}
+	list := ListScheduledJobs()
+	if len(list) != 2 || list[0].Id != "a" || list[1].Id != "b" {
+		t.Fatalf("jobs not sorted by next run: %v", list)
+	}
+	//执行中的任务在后台修改状态，列表中的副本不受影响
+	scheduleLock.Lock()
+	sooner.running = true
+	sooner.Attempts = 2
+	sooner.LastError = "connection refused"
+	scheduleLock.Unlock()
+	if text := list[0].Text(); strings.Contains(text, "running") || strings.Contains(text, "attempts") {
+		t.Errorf("snapshot changed: %s", text)
+	}
+	text := ListScheduledJobs()[0].Text()
+	for _, want := range []string{"a.txt -> pc", "running", "attempts:2", "error:connection refused"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("%q does not contain %q", text, want)
+		}
+	}
+}
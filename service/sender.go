@@ -4,12 +4,16 @@ import (
 	"errors"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 )
 
 /**
-send端口:tcp传输文件
-send端口+1:udp接收ip
+send端口:tcp传输文件，udp发送停止信号
+随机udp端口:发送发现查询并接收回复信标(ip与tcp端口)
+DiscoveryPort:udp接收接收端的定期通告
 */
 
 type SendHandler struct {
@@ -24,16 +28,18 @@ var SListItemEnable = true
 var Sender = SendHandler{}
 
 var connR net.PacketConn
-var connSendFile net.Conn
+var connAnnounce net.PacketConn
 
 // InitSetting 初始化设置
 func (r *SendHandler) InitSetting() {
 	Log("Init Sender")
 	r.State = Stopped
-	//设置默认接收端口
-	r.port = 32000
+	//读取设置中的目标端口与上次的目标
+	r.port = Setting.SenderPort
 	SenderPortInput.SetText(strconv.Itoa(int(r.port)))
+	SIpInput.SetText(Setting.LastTarget)
 	StopSendFileBtn.Disable()
+	LoadBookmarks()
 	Log("Init Sender Succeed")
 }
 
@@ -42,16 +48,9 @@ func (r *SendHandler) RunIpSearcher() error {
 	Log("Run IP Searcher")
 	if r.State == Running {
 		err := errors.New("repeated start")
-		LogErr(err.Error())
+		LogWarn(err.Error())
 		return err
 	}
-	//端口检查
-	port, err := PortCheck(SenderPortInput.Text)
-	if err != nil {
-		LogErr("Run Receiver Error:" + err.Error())
-		return err
-	}
-	r.port = port
 	r.RunIpReceiver()
 	r.State = Running
 	Log("Run IP Searcher Succeed")
@@ -63,17 +62,22 @@ func (r *SendHandler) StopIpSearcher() {
 	Log("Stop IP Searcher")
 	if r.State == Stopped {
 		err := errors.New("repeated stop")
-		LogErr(err.Error())
+		LogWarn(err.Error())
 		return
 	}
 	if connR != nil {
 		connR.Close()
+		connR = nil
+	}
+	if connAnnounce != nil {
+		connAnnounce.Close()
+		connAnnounce = nil
 	}
 	r.State = Stopped
 	Log("Stop IP Succeed")
 }
-func (r *SendHandler) PortS(offset uint16) string {
-	return strconv.FormatUint(uint64(r.port+offset), 10)
+func (r *SendHandler) PortS() string {
+	return strconv.FormatUint(uint64(r.port), 10)
 }
 func (r *SendHandler) SetFileSrc(src string) error {
 	fileInfo, err := os.Stat(src)
@@ -88,64 +92,80 @@ func (r *SendHandler) SetFileSrc(src string) error {
 	return nil
 }
 
+// RunIpReceiver 监听查询回复与接收端通告
 func (r *SendHandler) RunIpReceiver() {
 	Log("Run Ip Receiver...")
 	var err error
-	connR, err = net.ListenPacket("udp", ":"+r.PortS(1))
+	connR, err = net.ListenPacket("udp4", ":0")
 	if err != nil {
-		LogErr("Link error with port: " + r.PortS(1))
+		LogErr("Link error with discovery reply port:" + err.Error())
 		return
 	}
-	go func() {
-		defer func(connR net.PacketConn) {
-			if connR != nil {
-				connR.Close()
-			}
-		}(connR)
-		for {
-			_, addr, err := connR.ReadFrom(make([]byte, 8))
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					Log("RunIpReceiver closed")
-				} else {
-					LogErr("RunIpReceiver ReadFrom Error: " + err.Error())
-				}
-				return
-			}
-			ip, err := ExtractIPPartOfAddress(addr.String())
-			if err != nil {
-				LogErr("ExtractIPPartOfAddress Error:" + err.Error())
-				return
-			}
-			if AddSList(ip) {
-				Log("Get ip:" + ip)
+	go r.readBeacon(connR)
+	connAnnounce, err = ListenDiscovery()
+	if err != nil {
+		LogErr("Link error with port: " + DiscoveryPortS() + " " + err.Error())
+	} else {
+		go r.readBeacon(connAnnounce)
+	}
+	r.SendDiscoveryQuery()
+}
+
+// SendDiscoveryQuery 向组播地址与局域网广播地址发送发现查询
+func (r *SendHandler) SendDiscoveryQuery() {
+	if connR == nil {
+		return
+	}
+	broadcastIps, err := LanBroadcastIps()
+	if err != nil {
+		LogErr("Error obtaining local IP address:" + err.Error())
+	}
+	LogDebug("Send discovery query", F("targets", len(broadcastIps)+1))
+	SendBeacon(connR, EncodeBeacon(BeaconQuery, 0, ""), broadcastIps)
+}
+
+// RefreshIpSearcher 清空发现列表并重新查询
+func (r *SendHandler) RefreshIpSearcher() {
+	ClearSList()
+	r.SendDiscoveryQuery()
+}
+
+func (r *SendHandler) readBeacon(conn net.PacketConn) {
+	defer conn.Close()
+	beacon := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(beacon)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				Log("RunIpReceiver closed")
+			} else {
+				LogErr("RunIpReceiver ReadFrom Error: " + err.Error())
 			}
+			return
 		}
-	}()
+		kind, port, name, err := DecodeBeacon(beacon[:n])
+		if err != nil || kind != BeaconAnnounce {
+			continue
+		}
+		ip, err := ExtractIPPartOfAddress(addr.String())
+		if err != nil {
+			LogErr("ExtractIPPartOfAddress Error:" + err.Error())
+			continue
+		}
+		peer := Peer{Name: name, Host: ip, Port: port}
+		if AddSList(peer) {
+			Log("Get address", FPeer(peer.Address()), F("name", peer.Name))
+		}
+	}
 }
 func (r *SendHandler) SendFile() {
 	go func() {
-		SIpInput.Disable()
-		SenderPortInput.Disable()
-		SenderFileSelectBtn.Disable()
-		SenderFileSrcInput.Disable()
-		SendFileBtn.Disable()
-		StopSendFileBtn.Enable()
-		SListItemEnable = false
-		defer func() {
-			SIpInput.Enable()
-			SenderPortInput.Enable()
-			SenderFileSelectBtn.Enable()
-			SenderFileSrcInput.Enable()
-			SendFileBtn.Enable()
-			StopSendFileBtn.Disable()
-			SListItemEnable = true
-		}()
+		r.disableInput()
+		defer r.enableInput()
 		Log("Start sending files...")
-		//检查ip
-		err := IpCheck(SIpInput.Text)
+		peers, err := r.targets()
 		if err != nil {
-			LogErr("IP is illegal:" + err.Error())
+			LogErr(err.Error())
 			return
 		}
 		//检查文件
@@ -154,36 +174,284 @@ func (r *SendHandler) SendFile() {
 			LogErr("Wrong file path:" + err.Error())
 			return
 		}
-		//监听端口
-		connSendFile, err = net.Dial("tcp", SIpInput.Text+":"+r.PortS(0))
+		errs := SendToPeers(r.fileSrc, peers, OriginSender)
+		if len(peers) > 1 {
+			ShowSendSummary(peers, errs)
+		}
+	}()
+}
+
+// SendText 把文本发送给目标
+func (r *SendHandler) SendText(text string) {
+	if text == "" {
+		LogWarn("Text is empty")
+		return
+	}
+	go func() {
+		r.disableInput()
+		defer r.enableInput()
+		peers, err := r.targets()
 		if err != nil {
-			LogErr("Link error with " + SIpInput.Text + ":" + r.PortS(0) + err.Error())
+			LogErr(err.Error())
 			return
 		}
-		defer connSendFile.Close()
-		err = SendFile(r.fileSrc, connSendFile)
+		errs := SendTextToPeers(text, peers)
+		if len(peers) > 1 {
+			ShowSendSummary(peers, errs)
+		}
+	}()
+}
+
+// MirrorFolder 把本地文件夹依次镜像到各目标，完成后显示对比结果
+func (r *SendHandler) MirrorFolder(root, folder string, dryRun, deleteExtra bool) {
+	go func() {
+		r.disableInput()
+		defer r.enableInput()
+		peers, err := r.targets()
 		if err != nil {
-			if errors.Is(err, net.ErrClosed) {
-				Log("Send File Stopped")
-			} else {
-				LogErr(err.Error())
+			LogErr(err.Error())
+			return
+		}
+		if stat, err := os.Stat(root); err != nil || !stat.IsDir() {
+			LogErr("Wrong folder path:" + root)
+			return
+		}
+		plans := make([]MirrorPlan, len(peers))
+		errs := make([]error, len(peers))
+		for i, peer := range peers {
+			plans[i], errs[i] = MirrorFolder(peer, root, folder, dryRun, deleteExtra)
+			if errs[i] != nil {
+				LogErr("Mirror error:"+errs[i].Error(), FPeer(peer.Address()))
 			}
 		}
+		ShowMirrorResult(peers, plans, errs, dryRun, deleteExtra)
 	}()
 }
-func (r *SendHandler) StopSendFile() {
-	conn, err := net.Dial("udp", SIpInput.Text+":"+r.PortS(2))
+
+// SendClipboard 把剪贴板中的文本发送给目标
+func (r *SendHandler) SendClipboard() {
+	r.SendText(MainWindow.Clipboard().Content())
+}
+
+// targets 勾选了多个接收端时返回所有勾选的接收端，否则返回输入框中的目标
+func (r *SendHandler) targets() ([]Peer, error) {
+	peers := CheckedPeers()
+	if len(peers) > 0 {
+		return peers, nil
+	}
+	//检查ip或主机名
+	err := HostCheck(SIpInput.Text)
 	if err != nil {
-		LogErr("Link error with " + SIpInput.Text + ":" + r.PortS(2) + err.Error())
-		return
+		return nil, errors.New("Host is illegal:" + err.Error())
 	}
-	_, err = conn.Write([]byte{'1'})
+	//检查端口
+	port, err := PortCheck(SenderPortInput.Text)
 	if err != nil {
-		LogErr("Link write with " + SIpInput.Text + ":" + r.PortS(2) + err.Error())
-		return
+		return nil, errors.New("Port is illegal:" + err.Error())
+	}
+	r.port = port
+	Setting.SenderPort = port
+	Setting.LastTarget = SIpInput.Text
+	SaveConfig()
+	if i, ok := FindBookmark(SIpInput.Text, port); ok {
+		return []Peer{Bookmarks[i]}, nil
+	}
+	return []Peer{{Host: SIpInput.Text, Port: port}}, nil
+}
+func (r *SendHandler) disableInput() {
+	SIpInput.Disable()
+	SenderPortInput.Disable()
+	SenderFileSelectBtn.Disable()
+	SenderFileSrcInput.Disable()
+	SendFileBtn.Disable()
+	SendTextBtn.Disable()
+	SendClipboardBtn.Disable()
+	MirrorFolderBtn.Disable()
+	StopSendFileBtn.Enable()
+	SListItemEnable = false
+}
+func (r *SendHandler) enableInput() {
+	SIpInput.Enable()
+	SenderPortInput.Enable()
+	SenderFileSelectBtn.Enable()
+	SenderFileSrcInput.Enable()
+	SendFileBtn.Enable()
+	SendTextBtn.Enable()
+	SendClipboardBtn.Enable()
+	MirrorFolderBtn.Enable()
+	StopSendFileBtn.Disable()
+	SListItemEnable = true
+}
+
+// SendTextToPeers 把文本发送给多个接收端，返回每个接收端的结果
+func SendTextToPeers(text string, peers []Peer) []error {
+	errs := make([]error, len(peers))
+	wg := sync.WaitGroup{}
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			startTime := time.Now()
+			address := peers[i].Address()
+			errs[i] = sendText(peers[i], text)
+			RecordMessage(DirectionSent, address, text, startTime, errs[i])
+			if errs[i] != nil {
+				LogErr("Send text error:"+errs[i].Error(), FPeer(address))
+			} else {
+				Log("Send text", FPeer(address), FBytes(int64(len(text))))
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+func sendText(peer Peer, text string) error {
+	header := Header{Kind: KindText, Id: NewTransferId(), DeviceName: Setting.DeviceName, Token: peer.Token}
+	conn, _, err := dialTransfer(peer, header, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return WriteText(conn, text)
+}
+
+// SendToPeers 把同一个文件同时发送给多个接收端，文件只读取一次，失败的接收端单独重试，返回每个接收端的结果
+// origin为发送的来源，如OriginSender
+func SendToPeers(src string, peers []Peer, origin string) []error {
+	startTime := time.Now()
+	errs := make([]error, len(peers))
+	fileHeader, err := StatSendFile(src)
+	if err != nil {
+		for i, peer := range peers {
+			errs[i] = err
+			RecordTransfer(DirectionSent, peer.Address(), FileResult{Name: filepath.Base(src), Path: src}, startTime, err)
+		}
+		LogErr(err.Error(), FFile(src))
+		return errs
+	}
+	transfers := make([]*Transfer, len(peers))
+	watchers := make([]*replyWatcher, len(peers))
+	for i, peer := range peers {
+		transfers[i] = NewTransfer(NewTransferId(), DirectionSent, peer.Address(), peer.Name, nil)
+		transfers[i].SetOrigin(origin)
+		transfers[i].SetFile(fileHeader.Name, fileHeader.Size)
+	}
+	//并发连接所有接收端并发送传输头
+	wg := sync.WaitGroup{}
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			header := Header{Kind: KindFile, Id: transfers[i].Id, DeviceName: Setting.DeviceName, Token: peers[i].Token}
+			conn, _, err := dialTransfer(peers[i], header, &fileHeader)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			transfers[i].SetConn(conn)
+			watchers[i] = watchReplies(conn, transfers[i])
+		}(i)
+	}
+	wg.Wait()
+	fanOut := NewFanOutWriter()
+	index := make([]int, 0, len(peers))
+	connected := make([]*Transfer, 0, len(peers))
+	for i, transfer := range transfers {
+		if errs[i] == nil {
+			fanOut.Add(transfer, transfer.conn)
+			index = append(index, i)
+			connected = append(connected, transfer)
+		}
 	}
-	if connSendFile != nil {
-		connSendFile.Close()
+	results := make([]FileResult, len(peers))
+	if len(index) > 0 {
+		result, err := SendFile(src, fanOut, fileHeader, 0, connected...)
+		fanOut.Close()
+		//每个接收端写完缓冲后各自等待确认校验通过，暂停的接收端不影响其他接收端
+		for j, i := range index {
+			wg.Add(1)
+			go func(j, i int) {
+				defer wg.Done()
+				if err != nil {
+					transfers[i].conn.Close()
+				}
+				results[i] = result
+				if errs[i] = fanOut.Wait(j); errs[i] == nil {
+					errs[i] = err
+				}
+				if errs[i] == nil {
+					_, errs[i] = watchers[i].Final()
+				}
+				transfers[i].conn.Close()
+			}(j, i)
+		}
+		wg.Wait()
 	}
+	//连接失败或中断的接收端各自重试，从接收端确认的位置续传
+	for i := range peers {
+		if !retryable(errs[i], transfers[i]) || Setting.RetryCount <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = retrySendFile(src, fileHeader, peers[i], transfers[i], errs[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, peer := range peers {
+		transfers[i].Done()
+		if results[i].Name == "" {
+			results[i] = FileResult{Name: filepath.Base(src), Path: src}
+		}
+		RecordTransfer(DirectionSent, peer.Address(), results[i], startTime, errs[i])
+		NotifyTransfer(DirectionSent, peer.Address(), results[i], errs[i])
+		if errs[i] == nil {
+			continue
+		}
+		if errors.Is(errs[i], net.ErrClosed) {
+			Log("Send File Stopped", FPeer(peer.Address()))
+		} else {
+			LogErr(errs[i].Error(), FPeer(peer.Address()), FFile(src))
+		}
+	}
+	return errs
+}
+
+// StopSendFile 停止发送页发起的所有发送，热文件夹与定时发送不受影响
+func (r *SendHandler) StopSendFile() {
+	ActiveTransfers.Range(func(key TransferKey, value *Transfer) bool {
+		if value.Direction == DirectionSent && value.Origin() == OriginSender {
+			value.Cancel()
+		}
+		return true
+	})
 	Log("Stop Send File")
 }
+
+// SendStopSignal 通知接收端停止指定id的传输
+func SendStopSignal(address string, id TransferId) {
+	sendSignal(address, id[:])
+}
+
+// SendPauseSignal 通知接收端发送端暂停或恢复了指定id的传输
+func SendPauseSignal(address string, id TransferId, paused bool) {
+	status := ReplyResume
+	if paused {
+		status = ReplyPause
+	}
+	sendSignal(address, append([]byte{status}, id[:]...))
+}
+
+func sendSignal(address string, signal []byte) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		LogErr("Link error with " + address + " " + err.Error())
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write(signal)
+	if err != nil {
+		LogErr("Link write with " + address + " " + err.Error())
+	}
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Share 发布的文件，通过链接在浏览器中下载
+type Share struct {
+	Token     string
+	Path      string
+	Name      string
+	OneTime   bool
+	Expires   time.Time
+	CreatedAt time.Time
+	Downloads int
+}
+
+// UrlPath 下载链接的路径部分
+func (s *Share) UrlPath() string {
+	return "/d/" + s.Token + "/" + url.PathEscape(s.Name)
+}
+
+// Expired 是否已过期
+func (s *Share) Expired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
+}
+
+// Text 列表中显示的文本
+func (s *Share) Text() string {
+	shareLock.Lock()
+	downloads := s.Downloads
+	shareLock.Unlock()
+	builder := strings.Builder{}
+	builder.WriteString(s.Name)
+	builder.WriteString(" downloads:")
+	builder.WriteString(strconv.Itoa(downloads))
+	if s.OneTime {
+		builder.WriteString(" one-time")
+	}
+	if !s.Expires.IsZero() {
+		builder.WriteString(" expires:")
+		builder.WriteString(s.Expires.Format("2006-01-02 15:04:05"))
+	}
+	return builder.String()
+}
+
+var shares = map[string]*Share{}
+var shareLock sync.Mutex
+
+// PublishFile 发布文件，expire为0时不过期
+func PublishFile(path string, oneTime bool, expire time.Duration) (*Share, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, errors.New("file path is not a file")
+	}
+	token := make([]byte, 16)
+	if _, err = rand.Read(token); err != nil {
+		return nil, err
+	}
+	share := &Share{
+		Token:     hex.EncodeToString(token),
+		Path:      path,
+		Name:      filepath.Base(path),
+		OneTime:   oneTime,
+		CreatedAt: time.Now(),
+	}
+	if expire > 0 {
+		share.Expires = share.CreatedAt.Add(expire)
+	}
+	shareLock.Lock()
+	shares[share.Token] = share
+	shareLock.Unlock()
+	if err = RunWebServer(); err != nil {
+		UnpublishFile(share.Token)
+		return nil, err
+	}
+	fields := []Field{FFile(path), F("oneTime", oneTime)}
+	if !share.Expires.IsZero() {
+		fields = append(fields, F("expires", share.Expires.Format("2006-01-02 15:04:05")))
+	}
+	Log("Publish file", fields...)
+	RefreshShareList()
+	return share, nil
+}
+
+// UnpublishFile 取消发布，没有其他用途时停止http服务
+func UnpublishFile(token string) {
+	shareLock.Lock()
+	share, ok := shares[token]
+	delete(shares, token)
+	shareLock.Unlock()
+	if ok {
+		Log("Unpublish file", FFile(share.Path))
+	}
+	StopWebServer()
+	RefreshShareList()
+}
+
+// ShareCount 发布中的文件数
+func ShareCount() int {
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	return len(shares)
+}
+
+// ListShares 按发布时间排序的发布中的文件
+func ListShares() []*Share {
+	shareLock.Lock()
+	defer shareLock.Unlock()
+	list := make([]*Share, 0, len(shares))
+	for _, share := range shares {
+		list = append(list, share)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// countingWriter 统计写出的字节数，每次写入前延长期限，超过Setting.IdleTimeout没有写出时中断下载
+type countingWriter struct {
+	http.ResponseWriter
+	n          int64
+	controller *http.ResponseController
+	timeout    time.Duration
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		if err := w.controller.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, timeoutErr(err)
+}
+
+func handleShareDownload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/d/"), "/", 2)
+	shareLock.Lock()
+	share, ok := shares[parts[0]]
+	//一次性链接在第一次下载开始时就失效，之后的请求(包括并发与Range请求)都返回404
+	claimed := ok && share.OneTime && r.Method != http.MethodHead && !share.Expired()
+	if claimed {
+		delete(shares, share.Token)
+	}
+	shareLock.Unlock()
+	if claimed {
+		defer func() {
+			StopWebServer()
+			RefreshShareList()
+		}()
+	}
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if share.Expired() {
+		LogWarn("Download expired share", FPeer(address), FFile(share.Name))
+		UnpublishFile(share.Token)
+		http.Error(w, "link expired", http.StatusGone)
+		return
+	}
+	file, err := os.Open(share.Path)
+	if err != nil {
+		LogErr("Open shared file error:"+err.Error(), FFile(share.Path))
+		http.Error(w, "file not available", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		http.Error(w, "file not available", http.StatusNotFound)
+		return
+	}
+	startTime := time.Now()
+	Log("Start download", FPeer(address), FFile(share.Name), F("range", r.Header.Get("Range")))
+	transfer := NewTransfer(NewTransferId(), DirectionSent, address, "Browser", nil)
+	transfer.SetFile(share.Name, stat.Size())
+	cw := &countingWriter{ResponseWriter: w, controller: http.NewResponseController(w), timeout: timeoutOf(Setting.IdleTimeout)}
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(share.Name))
+	http.ServeContent(cw, r, share.Name, stat.ModTime(), &transferReadSeeker{file: file, reader: NewRateLimitedReader(file, transfer), transfer: transfer})
+	transfer.Done()
+	result := FileResult{Name: share.Name, Path: share.Path, Size: cw.n}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if share.OneTime {
+		Log("One-time link used", FPeer(address), FFile(share.Name))
+	}
+	//写出的字节数少于响应的Content-Length时客户端中断或下载被取消
+	var err2 error
+	if length, errL := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); errL == nil && cw.n < length {
+		err2 = errors.New("download interrupted after " + FormatByteSize(cw.n, 1))
+	}
+	//完整下载(非Range请求且字节数等于文件大小)才计入下载次数
+	if r.Header.Get("Range") == "" && cw.n == stat.Size() {
+		shareLock.Lock()
+		share.Downloads++
+		shareLock.Unlock()
+		Log("Downloaded", FPeer(address), FFile(share.Name), FBytes(cw.n))
+		RefreshShareList()
+	} else if err2 != nil {
+		LogWarn("Download error:"+err2.Error(), FPeer(address), FFile(share.Name))
+	} else {
+		Log("Partial download", FPeer(address), FFile(share.Name), FBytes(cw.n))
+	}
+	RecordTransfer(DirectionSent, address, result, startTime, err2)
+}
+
+// transferReadSeeker 按限速读取并把进度记录到传输页，取消时中断下载
+type transferReadSeeker struct {
+	file     *os.File
+	reader   io.Reader
+	transfer *Transfer
+}
+
+func (r *transferReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if _, errT := r.transfer.Write(p[:n]); errT != nil {
+			return 0, errT
+		}
+	}
+	return n, err
+}
+
+func (r *transferReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.file.Seek(offset, whence)
+}
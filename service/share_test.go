@@ -0,0 +1,50 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestShareDownloadIPv6 ipv6地址的下载端按ip记录
+func TestShareDownloadIPv6(t *testing.T) {
+	dir := t.TempDir()
+	savedConfig, savedHistory, savedIdle := ConfigPath, History, Setting.IdleTimeout
+	defer func() {
+		ConfigPath, History, Setting.IdleTimeout = savedConfig, savedHistory, savedIdle
+	}()
+	//ResponseRecorder不支持设置写超时
+	Setting.IdleTimeout = 0
+	ConfigPath = filepath.Join(dir, "config.json")
+	History = nil
+	path := filepath.Join(dir, "photo.jpg")
+	if err := os.WriteFile(path, []byte("not really a photo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	share := &Share{Token: "ipv6test", Path: path, Name: "photo.jpg", CreatedAt: time.Now()}
+	shareLock.Lock()
+	shares[share.Token] = share
+	shareLock.Unlock()
+	defer func() {
+		shareLock.Lock()
+		delete(shares, share.Token)
+		shareLock.Unlock()
+	}()
+
+	r := httptest.NewRequest(http.MethodGet, share.UrlPath(), nil)
+	r.RemoteAddr = "[fe80::1%eth0]:53000"
+	w := httptest.NewRecorder()
+	handleShareDownload(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "not really a photo" {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if len(History) != 1 || History[0].Peer != "fe80::1%eth0" || History[0].Outcome != OutcomeSuccess {
+		t.Fatalf("history %+v", History)
+	}
+	if share.Downloads != 1 {
+		t.Errorf("downloads %d", share.Downloads)
+	}
+}
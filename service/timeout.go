@@ -0,0 +1,158 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 连接超时的默认值，单位秒，0为不限制
+const (
+	DefaultDialTimeout      = 10
+	DefaultHandshakeTimeout = 10
+	DefaultIdleTimeout      = 60
+)
+
+// ErrTimedOut 连接、握手或传输中长时间没有数据
+var ErrTimedOut = errors.New("timed out")
+
+func timeoutOf(seconds int) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+// timeoutError 超时错误，错误信息以"timed out:"开头，errors.Is(err, ErrTimedOut)为true
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return "timed out:" + e.err.Error()
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimedOut
+}
+
+// timeoutErr 把读写期限到期的错误包装为timeoutError，保留原错误以便判断是否重试
+func timeoutErr(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && !errors.Is(err, ErrTimedOut) {
+		return &timeoutError{err: err}
+	}
+	return err
+}
+
+// DialTCP 按Setting.DialTimeout连接
+func DialTCP(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeoutOf(Setting.DialTimeout))
+	return conn, timeoutErr(err)
+}
+
+// SetHandshakeDeadline 传输头与回复需在Setting.HandshakeTimeout内完成
+func SetHandshakeDeadline(conn net.Conn) error {
+	if Setting.HandshakeTimeout <= 0 {
+		return conn.SetDeadline(time.Time{})
+	}
+	return conn.SetDeadline(time.Now().Add(timeoutOf(Setting.HandshakeTimeout)))
+}
+
+// IdleConn 每次读写前重新设置期限，超过Setting.IdleTimeout没有读到或写出数据时返回ErrTimedOut
+// 本端暂停时不会读写连接，恢复后重新计时，对端通知暂停后调用Suspend停止计时
+type IdleConn struct {
+	net.Conn
+	timeout   time.Duration
+	suspended atomic.Bool
+	//接收端的暂停通知与校验结果可能在不同的goroutine中写入
+	writeLock sync.Mutex
+}
+
+// NewIdleConn 清除握手期限并开始按空闲超时读写
+func NewIdleConn(conn net.Conn) *IdleConn {
+	conn.SetDeadline(time.Time{})
+	return &IdleConn{Conn: conn, timeout: timeoutOf(Setting.IdleTimeout)}
+}
+
+// Suspend 对端暂停时清除正在进行的读写的期限且不再计时，恢复后从下一次读写开始重新计时
+func (c *IdleConn) Suspend(suspend bool) {
+	c.suspended.Store(suspend)
+	if suspend {
+		c.Conn.SetDeadline(time.Time{})
+	}
+}
+
+// Suspended 对端是否处于暂停中
+func (c *IdleConn) Suspended() bool {
+	return c.suspended.Load()
+}
+
+func (c *IdleConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 && !c.suspended.Load() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return 0, err
+		}
+		//设置期限的同时对端通知了暂停
+		if c.suspended.Load() {
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+	}
+	n, err := c.Conn.Read(p)
+	return n, timeoutErr(err)
+}
+
+// idleWriteChunk 每次写入连接的最大字节数，大缓冲区分段写入，每段重新计时，接收端慢速读取时不会被当作空闲
+const idleWriteChunk = 64 << 10
+
+func (c *IdleConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	written := 0
+	for written < len(p) {
+		end := written + idleWriteChunk
+		if end > len(p) {
+			end = len(p)
+		}
+		if c.timeout > 0 && !c.suspended.Load() {
+			if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+				return written, err
+			}
+			if c.suspended.Load() {
+				c.Conn.SetWriteDeadline(time.Time{})
+			}
+		}
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, timeoutErr(err)
+		}
+	}
+	return written, nil
+}
+
+// idleBody 浏览器上传时每次读取前延长期限，超过Setting.IdleTimeout没有数据时中断上传
+type idleBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	timeout    time.Duration
+}
+
+func newIdleBody(w http.ResponseWriter, body io.ReadCloser) *idleBody {
+	return &idleBody{ReadCloser: body, controller: http.NewResponseController(w), timeout: timeoutOf(Setting.IdleTimeout)}
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	if b.timeout > 0 {
+		if err := b.controller.SetReadDeadline(time.Now().Add(b.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	return n, timeoutErr(err)
+}
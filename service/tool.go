@@ -5,8 +5,14 @@ import (
 	"fmt"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/widget"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,38 +45,53 @@ func (r *IShowSpeed) nextTurn() {
 }
 
 // ProgressBarHook 用于显示把读取调用进度输出到进度条
+// now与target由传输的协程修改，更新界面的协程读取，因此为原子值
 type ProgressBarHook struct {
 	progressBar *widget.ProgressBar
 	speedText   *canvas.Text
-	target      int64
-	now         int64
+	target      atomic.Int64
+	now         atomic.Int64
 	closeSignal chan struct{}
+	//done Close等待更新界面的协程退出，之后下一个传输才能使用同一个进度条
+	done sync.WaitGroup
+	//transfers 进度条显示的传输，速度后显示其中最低的实际限速
+	lock      sync.Mutex
+	transfers []*Transfer
 }
 
-func NewProgressBarHook(progressBar *widget.ProgressBar, speedText *canvas.Text, target int64) *ProgressBarHook {
+// NewProgressBarHook transfers为该进度条显示的传输，用于显示实际的限速
+func NewProgressBarHook(progressBar *widget.ProgressBar, speedText *canvas.Text, target int64, transfers ...*Transfer) *ProgressBarHook {
 	p := &ProgressBarHook{
 		progressBar: progressBar,
 		speedText:   speedText,
-		target:      target,
-		now:         0,
 		closeSignal: make(chan struct{}),
 	}
+	for _, transfer := range transfers {
+		if transfer != nil {
+			p.transfers = append(p.transfers, transfer)
+		}
+	}
+	p.target.Store(target)
+	p.done.Add(2)
 	go func(pbh *ProgressBarHook) {
+		defer pbh.done.Done()
 		for {
 			select {
 			case <-pbh.closeSignal:
 				pbh.progressBar.SetValue(0)
 				return
 			case <-time.After(time.Millisecond * 100):
-				if pbh.now < pbh.target {
-					pbh.progressBar.SetValue(float64(pbh.now) / float64(pbh.target))
-				} else if pbh.target == 0 && pbh.progressBar.Value != 0 {
+				now, target := pbh.now.Load(), pbh.target.Load()
+				if now < target {
+					pbh.progressBar.SetValue(float64(now) / float64(target))
+				} else if target == 0 && pbh.progressBar.Value != 0 {
 					pbh.progressBar.SetValue(0)
 				}
 			}
 		}
 	}(p)
 	go func(pbh *ProgressBarHook) {
+		defer pbh.done.Done()
 		cycle := time.Millisecond * 250
 		sampling := cycle * 4
 		iShowSpeed := NewIShowSpeed(4)
@@ -81,7 +102,8 @@ func NewProgressBarHook(progressBar *widget.ProgressBar, speedText *canvas.Text,
 				pbh.speedText.Refresh()
 				return
 			case <-time.After(cycle):
-				pbh.speedText.Text = FormatSpeedAndArrivalTime(iShowSpeed.Beat(pbh.now), 1, sampling.Milliseconds(), pbh.target-pbh.now)
+				now := pbh.now.Load()
+				pbh.speedText.Text = FormatSpeedAndArrivalTime(iShowSpeed.Beat(now), 1, sampling.Milliseconds(), pbh.target.Load()-now) + RateCapText(pbh.Limit())
 				pbh.speedText.Refresh()
 			}
 		}
@@ -90,11 +112,30 @@ func NewProgressBarHook(progressBar *widget.ProgressBar, speedText *canvas.Text,
 	return p
 }
 func (r *ProgressBarHook) Write(p []byte) (n int, err error) {
-	r.now += int64(len(p))
+	r.now.Add(int64(len(p)))
 	return len(p), nil
 }
+
+// Limit 进度条上显示的限速，为各传输单独限速与全局限速中最低的非0值，没有传输时为全局限速
+func (r *ProgressBarHook) Limit() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.transfers) == 0 {
+		return GlobalLimiter.Rate()
+	}
+	lowest := int64(0)
+	for _, transfer := range r.transfers {
+		if rate := transfer.Limit(); rate > 0 && (lowest == 0 || rate < lowest) {
+			lowest = rate
+		}
+	}
+	return lowest
+}
+
+// Close 停止更新并等待更新界面的协程退出
 func (r *ProgressBarHook) Close() {
 	close(r.closeSignal)
+	r.done.Wait()
 }
 
 type MultipleProgressBarHook struct {
@@ -104,12 +145,27 @@ type MultipleProgressBarHook struct {
 func NewMultipleProgressBarHook(progressBar *widget.ProgressBar, speedText *canvas.Text) *MultipleProgressBarHook {
 	return &MultipleProgressBarHook{NewProgressBarHook(progressBar, speedText, 0)}
 }
-func (r *MultipleProgressBarHook) AddPB(num int64) {
-	r.target += num
+
+// AddPB 开始接收transfer中num个字节
+func (r *MultipleProgressBarHook) AddPB(num int64, transfer *Transfer) {
+	r.target.Add(num)
+	r.lock.Lock()
+	r.transfers = append(r.transfers, transfer)
+	r.lock.Unlock()
 }
-func (r *MultipleProgressBarHook) RemovePb(nowN, num int64) {
-	r.now -= nowN
-	r.target -= num
+
+// RemovePb transfer接收结束，nowN为已计入进度的字节数
+func (r *MultipleProgressBarHook) RemovePb(nowN, num int64, transfer *Transfer) {
+	r.now.Add(-nowN)
+	r.target.Add(-num)
+	r.lock.Lock()
+	for i, item := range r.transfers {
+		if item == transfer {
+			r.transfers = append(r.transfers[:i], r.transfers[i+1:]...)
+			break
+		}
+	}
+	r.lock.Unlock()
 }
 
 // ReplaceLastOctet 替换ip后缀
@@ -141,6 +197,47 @@ func IpCheck(ip string) error {
 	return nil
 }
 
+// HostCheck 检查IP或主机名是否合法
+func HostCheck(host string) error {
+	if IpCheck(host) == nil {
+		return nil
+	}
+	if host == "" || len(host) > 253 {
+		return errors.New("host name format error: Length")
+	}
+	allDigit := true
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("host name format error: Label")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return errors.New("host name format error: Char")
+			}
+			if c < '0' || c > '9' {
+				allDigit = false
+			}
+		}
+	}
+	if allDigit {
+		return IpCheck(host)
+	}
+	return nil
+}
+
+// AppConfigDir 获取并创建用户配置目录下的程序目录
+func AppConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "LAN_Transfer")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
 // ExtractIPPartOfAddress 提取ip地址部分
 func ExtractIPPartOfAddress(row string) (string, error) {
 	parts := strings.Split(row, ":")
@@ -151,6 +248,33 @@ func ExtractIPPartOfAddress(row string) (string, error) {
 	return parts[0], nil
 }
 
+// LanIps 获取本机的局域网ip
+func LanIps() ([]string, error) {
+	localIpList := make([]string, 0)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.IsPrivate() && ipnet.IP.To4() != nil {
+			localIpList = append(localIpList, ipnet.IP.String())
+		}
+	}
+	return localIpList, nil
+}
+
+// LanBroadcastIps 获取本机各局域网网段的广播地址
+func LanBroadcastIps() ([]string, error) {
+	localIpList, err := LanIps()
+	if err != nil {
+		return nil, err
+	}
+	for i, ip := range localIpList {
+		localIpList[i] = ReplaceLastOctet(ip, "255")
+	}
+	return localIpList, nil
+}
+
 // PortCheck 检查端口是否合法
 func PortCheck(port string) (uint16, error) {
 	var out uint16
@@ -166,11 +290,73 @@ func PortCheck(port string) (uint16, error) {
 	return out, nil
 }
 
+// TimeoutCheck 检查超时秒数，0为不限制
+func TimeoutCheck(seconds string) (int, error) {
+	atoi, err := strconv.Atoi(seconds)
+	if err != nil {
+		return 0, errors.New("timeout format error")
+	}
+	if atoi < 0 || atoi > 86400 {
+		return 0, errors.New("timeout range error")
+	}
+	return atoi, nil
+}
+
+// RetryCountCheck 检查发送重试次数
+func RetryCountCheck(count string) (int, error) {
+	atoi, err := strconv.Atoi(count)
+	if err != nil {
+		return 0, errors.New("retry count format error")
+	}
+	if atoi < 0 || atoi > 100 {
+		return 0, errors.New("retry count range error")
+	}
+	return atoi, nil
+}
+
 // FormatByteSpeed 格式化字节传输速率(每秒)
 func FormatByteSpeed(bPerSeconds int64, precision int) string {
 	return FormatByteSize(bPerSeconds, precision) + "/s"
 }
 
+// ParseByteSize 解析字节数文本，如500K、2M、1.5GB，空为0
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(s, "B")
+	if s == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		unit = 1 << 10
+	case 'M':
+		unit = 1 << 20
+	case 'G':
+		unit = 1 << 30
+	case 'T':
+		unit = 1 << 40
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("size is not a number")
+	}
+	if value < 0 {
+		return 0, errors.New("size must not be negative")
+	}
+	//float64(math.MaxInt64)等于2^63，转换时已溢出
+	if value*float64(unit) >= math.MaxInt64 {
+		return 0, errors.New("size is too large")
+	}
+	return int64(value * float64(unit)), nil
+}
+
 // FormatByteSize 格式化字节数单位
 func FormatByteSize(bPerSeconds int64, precision int) string {
 	if bPerSeconds < 0 {
@@ -0,0 +1,411 @@
+package service
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer 一个进行中的传输，以传输id区分，用于在传输页单独显示进度、暂停与取消
+type Transfer struct {
+	Id        TransferId
+	Direction string
+	Peer      string
+	Device    string
+	StartTime time.Time
+
+	conn    net.Conn
+	limiter *RateLimiter
+	lock    sync.Mutex
+	name    string
+	target  atomic.Int64
+	now     atomic.Int64
+
+	pauseCond *sync.Cond
+	paused    bool
+	canceled  bool
+	//peerPaused 对端暂停中，pauseReply 接收端暂停时通过连接回复通知发送端(仅文件传输)
+	peerPaused bool
+	pauseReply bool
+	//lastReply 上次发送进度回复的时间
+	lastReply time.Time
+	//origin 发送的来源，见OriginSender等
+	origin string
+	//attempt 当前是第几次尝试，retryAt 等待重试时下次尝试的时间
+	attempt int
+	retryAt time.Time
+	stop    chan struct{}
+
+	lastNow   int64
+	lastTime  time.Time
+	speedText string
+}
+
+// TransferKey 进行中的传输按方向与传输id区分，本机发送给自己时两端的传输id相同
+type TransferKey struct {
+	Direction string
+	Id        TransferId
+}
+
+var ActiveTransfers = SyncMap[TransferKey, *Transfer]{}
+
+// receivingIds 接收中(包括握手阶段)的传输id，同一id同时只接受一个连接
+var receivingIds = SyncMap[TransferId, struct{}]{}
+
+// claimReceive 登记接收的传输id，该id已在接收中时返回false，接收结束后调用releaseReceive
+func claimReceive(id TransferId) bool {
+	_, loaded := receivingIds.LoadOrStore(id, struct{}{})
+	return !loaded
+}
+
+func releaseReceive(id TransferId) {
+	receivingIds.Delete(id)
+}
+
+// 发送的来源，发送页的停止按钮只取消发送页发起的传输
+const (
+	OriginSender    = "Sender"
+	OriginHotFolder = "Hot folder"
+	OriginSchedule  = "Schedule"
+)
+
+// TransferRefreshInterval 传输页刷新间隔
+const TransferRefreshInterval = 500 * time.Millisecond
+
+// NewTransfer 登记一个进行中的传输
+func NewTransfer(id TransferId, direction, peer, device string, conn net.Conn) *Transfer {
+	t := &Transfer{
+		Id:        id,
+		Direction: direction,
+		Peer:      peer,
+		Device:    device,
+		StartTime: time.Now(),
+		conn:      conn,
+		limiter:   NewRateLimiter(Setting.TransferRateLimit),
+		lastTime:  time.Now(),
+		speedText: "  0.0B/s t:0s",
+		attempt:   1,
+		stop:      make(chan struct{}),
+	}
+	t.pauseCond = sync.NewCond(&t.lock)
+	ActiveTransfers.Store(t.Key(), t)
+	RefreshTransferList()
+	return t
+}
+
+// Key 在ActiveTransfers中的键
+func (t *Transfer) Key() TransferKey {
+	return TransferKey{Direction: t.Direction, Id: t.Id}
+}
+
+// SetFile 设置正在传输的文件名与大小，大小未知时为-1
+func (t *Transfer) SetFile(name string, size int64) {
+	t.lock.Lock()
+	t.name = name
+	t.lock.Unlock()
+	t.target.Store(size)
+	t.now.Store(0)
+}
+
+// SetOffset 续传时从已确认的字节数开始计算进度
+func (t *Transfer) SetOffset(offset int64) {
+	t.now.Store(offset)
+	t.lock.Lock()
+	t.lastNow = offset
+	t.lock.Unlock()
+}
+
+// SetConn 重试时替换连接
+func (t *Transfer) SetConn(conn net.Conn) {
+	t.lock.Lock()
+	t.conn = conn
+	t.retryAt = time.Time{}
+	t.peerPaused = false
+	t.lock.Unlock()
+}
+
+// SetOrigin 设置发送的来源
+func (t *Transfer) SetOrigin(origin string) {
+	t.lock.Lock()
+	t.origin = origin
+	t.lock.Unlock()
+}
+func (t *Transfer) Origin() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.origin
+}
+
+// SetPauseReply 接收文件时暂停与恢复通过连接回复通知发送端
+func (t *Transfer) SetPauseReply() {
+	t.lock.Lock()
+	t.pauseReply = true
+	t.lock.Unlock()
+}
+
+// WaitRetry 等待到下一次尝试，期间被取消时返回false
+func (t *Transfer) WaitRetry(attempt int, delay time.Duration) bool {
+	t.lock.Lock()
+	t.attempt = attempt
+	t.retryAt = time.Now().Add(delay)
+	t.lock.Unlock()
+	RefreshTransferList()
+	select {
+	case <-time.After(delay):
+		return !t.Canceled()
+	case <-t.stop:
+		return false
+	}
+}
+
+// Attempt 当前是第几次尝试
+func (t *Transfer) Attempt() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.attempt
+}
+func (t *Transfer) Canceled() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.canceled
+}
+func (t *Transfer) Name() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.name
+}
+
+// waitResume 暂停时阻塞直到恢复或取消，取消后返回net.ErrClosed
+func (t *Transfer) waitResume() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for t.paused && !t.canceled {
+		t.pauseCond.Wait()
+	}
+	if t.canceled {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// Write 记录进度，暂停时阻塞拷贝直到恢复或取消，取消后返回net.ErrClosed
+func (t *Transfer) Write(p []byte) (n int, err error) {
+	t.lock.Lock()
+	for t.paused && !t.canceled {
+		t.pauseCond.Wait()
+	}
+	canceled := t.canceled
+	var conn net.Conn
+	if t.pauseReply && time.Since(t.lastReply) >= ProgressReplyInterval {
+		conn = t.conn
+		t.lastReply = time.Now()
+	}
+	t.lock.Unlock()
+	if canceled {
+		return 0, net.ErrClosed
+	}
+	now := t.now.Add(int64(len(p)))
+	if conn != nil {
+		//发送端写完后内容可能还在缓冲区中，定时回复进度避免发送端在等待校验结果时超时
+		if err = WriteReply(conn, Reply{Status: ReplyProgress, Offset: now}); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// SetPaused 暂停或恢复传输
+func (t *Transfer) SetPaused(paused bool) {
+	t.lock.Lock()
+	t.paused = paused
+	conn, pauseReply := t.conn, t.pauseReply
+	t.lock.Unlock()
+	t.pauseCond.Broadcast()
+	if paused {
+		Log("Pause transfer", F("id", t.Id), FPeer(t.Peer), FFile(t.Name()))
+	} else {
+		Log("Resume transfer", F("id", t.Id), FPeer(t.Peer), FFile(t.Name()))
+	}
+	//通知对端，暂停期间对端不按空闲超时断开
+	if conn != nil && t.Direction == DirectionSent {
+		SendPauseSignal(t.Peer, t.Id, paused)
+	} else if conn != nil && pauseReply {
+		status := ReplyResume
+		if paused {
+			status = ReplyPause
+		}
+		if err := WriteReply(conn, Reply{Status: status}); err != nil {
+			LogDebug("Send pause reply error:"+err.Error(), FPeer(t.Peer))
+		}
+	}
+	RefreshTransferList()
+}
+
+// SetPeerPaused 对端暂停或恢复，暂停期间连接不按空闲超时断开
+func (t *Transfer) SetPeerPaused(paused bool) {
+	t.lock.Lock()
+	t.peerPaused = paused
+	conn := t.conn
+	t.lock.Unlock()
+	if idle, ok := conn.(*IdleConn); ok {
+		idle.Suspend(paused)
+	}
+	if paused {
+		Log("Peer paused transfer", F("id", t.Id), FPeer(t.Peer), FFile(t.Name()))
+	} else {
+		Log("Peer resumed transfer", F("id", t.Id), FPeer(t.Peer), FFile(t.Name()))
+	}
+	RefreshTransferList()
+}
+func (t *Transfer) Paused() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.paused
+}
+
+// SetLimit 修改该传输的限速，0为不限速
+func (t *Transfer) SetLimit(rate int64) {
+	t.limiter.SetRate(rate)
+	Log("Set transfer rate limit", F("id", t.Id), FPeer(t.Peer), F("rate", FormatRate(rate)))
+	RefreshTransferList()
+}
+
+// Limit 该传输实际生效的限速，单独限速与全局限速同时生效，取较小的非0值
+func (t *Transfer) Limit() int64 {
+	rate, global := t.limiter.Rate(), GlobalLimiter.Rate()
+	if rate <= 0 || (global > 0 && global < rate) {
+		return global
+	}
+	return rate
+}
+
+// SizeKnown 是否知道传输的大小，未知时无法计算进度与剩余时间
+func (t *Transfer) SizeKnown() bool {
+	return t.target.Load() >= 0
+}
+
+// Progress 传输进度0~1
+func (t *Transfer) Progress() float64 {
+	target := t.target.Load()
+	if target <= 0 {
+		return 0
+	}
+	return float64(t.now.Load()) / float64(target)
+}
+
+// SpeedText 速度与剩余时间
+func (t *Transfer) SpeedText() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.speedText
+}
+
+// Text 传输页中显示的文本
+func (t *Transfer) Text() string {
+	peer := t.Peer
+	if t.Device != "" {
+		peer = t.Device + "(" + t.Peer + ")"
+	}
+	if t.Direction == DirectionReceived {
+		peer = "From " + peer
+	} else {
+		peer = "To " + peer
+	}
+	t.lock.Lock()
+	attempt, retryAt, peerPaused := t.attempt, t.retryAt, t.peerPaused
+	t.lock.Unlock()
+	text := peer + " " + t.Name()
+	if !retryAt.IsZero() {
+		return text + "  retry " + strconv.Itoa(attempt) + " in " + FormatSeconds(int64(time.Until(retryAt).Seconds()))
+	}
+	if attempt > 1 {
+		text += " attempt:" + strconv.Itoa(attempt)
+	}
+	if t.Paused() {
+		return text + "  paused"
+	}
+	if peerPaused {
+		return text + "  paused by peer"
+	}
+	return text + t.SpeedText() + RateCapText(t.Limit())
+}
+
+func (t *Transfer) updateSpeed() {
+	now := t.now.Load()
+	nowTime := time.Now()
+	t.lock.Lock()
+	durationMS := nowTime.Sub(t.lastTime).Milliseconds()
+	if durationMS > 0 {
+		if target := t.target.Load(); target >= 0 {
+			t.speedText = FormatSpeedAndArrivalTime(now-t.lastNow, 1, durationMS, target-now)
+		} else {
+			//大小未知时显示已传输的字节数代替剩余时间
+			t.speedText = "  " + FormatByteSpeed((now-t.lastNow)/durationMS*1000, 1) + " " + FormatByteSize(now, 1)
+		}
+		t.lastNow = now
+		t.lastTime = nowTime
+	}
+	t.lock.Unlock()
+}
+
+// Cancel 关闭连接以取消传输，通过协议发送中的传输同时通知接收端
+func (t *Transfer) Cancel() {
+	Log("Cancel transfer", F("id", t.Id), FPeer(t.Peer), FFile(t.Name()))
+	t.lock.Lock()
+	if !t.canceled {
+		close(t.stop)
+	}
+	t.canceled = true
+	conn := t.conn
+	t.lock.Unlock()
+	t.pauseCond.Broadcast()
+	if t.Direction == DirectionSent && conn != nil {
+		SendStopSignal(t.Peer, t.Id)
+	}
+	if t.Direction == DirectionReceived {
+		canceledTransfers.Store(t.Id, time.Now())
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Done 传输结束后移出列表
+func (t *Transfer) Done() {
+	ActiveTransfers.Delete(t.Key())
+	RefreshTransferList()
+}
+
+// ListTransfers 按开始时间排序的进行中的传输
+func ListTransfers() []*Transfer {
+	list := make([]*Transfer, 0)
+	ActiveTransfers.Range(func(key TransferKey, value *Transfer) bool {
+		list = append(list, value)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+	return list
+}
+
+// RunTransferMonitor 定时刷新各传输的速度与进度
+func RunTransferMonitor() {
+	go func() {
+		ticker := time.NewTicker(TransferRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			transfers := ListTransfers()
+			if len(transfers) == 0 {
+				continue
+			}
+			for _, t := range transfers {
+				t.updateSpeed()
+			}
+			RefreshTransferList()
+		}
+	}()
+}
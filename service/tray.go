@@ -0,0 +1,97 @@
+package service
+
+import (
+	"errors"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/driver/desktop"
+	"net"
+)
+
+var trayMenu *fyne.Menu
+var trayReceiveItem *fyne.MenuItem
+
+// trayHintShown 第一次最小化到托盘时提示程序仍在运行
+var trayHintShown bool
+
+// InitTray 设置系统托盘菜单，关闭窗口时按设置最小化到托盘(默认关闭)，继续在后台接收
+// fyne无法得知桌面环境是否真的显示托盘，因此只在用户勾选后才隐藏窗口
+func InitTray() {
+	desk, ok := MainApp.(desktop.App)
+	if !ok {
+		LogDebug("System tray is not supported")
+		MinimizeToTrayCheck.SetChecked(false)
+		MinimizeToTrayCheck.Disable()
+		return
+	}
+	trayReceiveItem = fyne.NewMenuItem("Receive", func() {
+		ToggleReceive()
+	})
+	trayMenu = fyne.NewMenu("LAN Transfer",
+		fyne.NewMenuItem("Show", func() {
+			MainWindow.Show()
+			MainWindow.RequestFocus()
+		}),
+		trayReceiveItem,
+		fyne.NewMenuItem("Open downloads folder", func() {
+			OpenFolder(Receiver.fileSrc)
+		}),
+	)
+	desk.SetSystemTrayMenu(trayMenu)
+	RefreshTray()
+	MainWindow.SetCloseIntercept(func() {
+		if !Setting.MinimizeToTray {
+			MainApp.Quit()
+			return
+		}
+		MainWindow.Hide()
+		//不受Setting.Notifications影响，否则隐藏窗口后用户不知道程序仍在运行
+		if !trayHintShown {
+			trayHintShown = true
+			MainApp.SendNotification(fyne.NewNotification("LAN Transfer", "Still running in the system tray, use Quit in the tray menu to exit"))
+		}
+	})
+}
+
+// RefreshTray 按接收状态更新托盘菜单
+func RefreshTray() {
+	if trayMenu == nil {
+		return
+	}
+	trayReceiveItem.Checked = Receiver.state == Running
+	trayMenu.Refresh()
+}
+
+// ToggleReceive 开启或关闭接收，与接收页的开关同步
+func ToggleReceive() {
+	if Receiver.state == Running {
+		ReceiverSwitch.SetSelected("Receive Disable")
+	} else {
+		ReceiverSwitch.SetSelected("Receive Enable")
+	}
+}
+
+// Notify 发送桌面通知，Setting.Notifications关闭时不发送
+func Notify(title, content string) {
+	if !Setting.Notifications {
+		return
+	}
+	MainApp.SendNotification(fyne.NewNotification(title, content))
+}
+
+// NotifyTransfer 传输完成或失败时通知，停止的传输不通知
+func NotifyTransfer(direction, peer string, result FileResult, err error) {
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
+	content := result.Name + " (" + FormatByteSize(result.Size, 1) + ")"
+	switch {
+	case err != nil && direction == DirectionSent:
+		Notify("Send failed", result.Name+" to "+peer+": "+err.Error())
+	case err != nil:
+		Notify("Receive failed", result.Name+" from "+peer+": "+err.Error())
+	case direction == DirectionSent:
+		Notify("File sent", content+" to "+peer)
+	default:
+		Notify("File received", content+" from "+peer)
+	}
+}
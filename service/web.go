@@ -0,0 +1,295 @@
+package service
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+web端口:http服务
+/ 与 /upload:浏览器上传文件到接收端，接收端设置了配对码时需要带上?token=配对码
+/d/<token>/<文件名>:下载发送端发布的文件，支持Range断点续传
+*/
+
+var webServer *http.Server
+var webLock sync.Mutex
+
+// webUploadDir 浏览器上传的保存路径，为空时不接受上传
+var webUploadDir string
+
+// RunWebServer 启动http服务，已启动时不重复启动
+func RunWebServer() error {
+	webLock.Lock()
+	defer webLock.Unlock()
+	if webServer != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(int(Setting.WebPort)))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleUploadPage)
+	mux.HandleFunc("/upload", handleUpload)
+	mux.HandleFunc("/d/", handleShareDownload)
+	webServer = &http.Server{Handler: mux, ReadHeaderTimeout: timeoutOf(Setting.HandshakeTimeout), IdleTimeout: timeoutOf(Setting.IdleTimeout)}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogErr("Web server error:" + err.Error())
+		}
+	}(webServer)
+	Log("Run web server", F("port", Setting.WebPort))
+	return nil
+}
+
+// StopWebServer 没有开启上传也没有发布的文件时停止http服务
+func StopWebServer() {
+	webLock.Lock()
+	defer webLock.Unlock()
+	if webServer == nil || webUploadDir != "" || ShareCount() > 0 {
+		return
+	}
+	webServer.Close()
+	webServer = nil
+	Log("Stop web server")
+}
+
+// WebUrls 本机各局域网ip对应的上传页地址，设置了配对码时包含配对码
+func WebUrls() []string {
+	path := "/"
+	if Setting.PairingToken != "" {
+		path += "?token=" + url.QueryEscape(Setting.PairingToken)
+	}
+	return WebUrlsOf(path)
+}
+
+// WebUrlsOf 本机各局域网ip对应的指定路径的访问地址
+func WebUrlsOf(path string) []string {
+	ips, err := LanIps()
+	if err != nil {
+		LogErr("Error obtaining local IP address:" + err.Error())
+		return nil
+	}
+	urls := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		urls = append(urls, "http://"+net.JoinHostPort(ip, strconv.Itoa(int(Setting.WebPort)))+path)
+	}
+	return urls
+}
+
+// SetWebUpload 设置浏览器上传的保存路径并启动http服务，dir为空时关闭上传
+func SetWebUpload(dir string) error {
+	webLock.Lock()
+	webUploadDir = dir
+	webLock.Unlock()
+	if dir == "" {
+		StopWebServer()
+		return nil
+	}
+	return RunWebServer()
+}
+func getWebUploadDir() string {
+	webLock.Lock()
+	defer webLock.Unlock()
+	return webUploadDir
+}
+
+var uploadPage = template.Must(template.New("upload").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>LAN Transfer</title>
+</head>
+<body>
+<h3>Send files to {{.Device}}</h3>
+<form action="/upload{{if .Token}}?token={{.Token}}{{end}}" method="post" enctype="multipart/form-data">
+<p><input type="file" name="file" multiple required></p>
+<p><input type="submit" value="Upload"></p>
+</form>
+{{range .Results}}<p>{{.}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+func renderUploadPage(w http.ResponseWriter, token string, results []string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := uploadPage.Execute(w, struct {
+		Device  string
+		Token   string
+		Results []string
+	}{Setting.DeviceName, token, results})
+	if err != nil {
+		LogErr("Render upload page error:" + err.Error())
+	}
+}
+
+func handleUploadPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || getWebUploadDir() == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if !CheckPairingToken(token) {
+		LogWarn("Reject web upload page:pairing token mismatch", FPeer(r.RemoteAddr))
+		http.Error(w, "pairing token required", http.StatusForbidden)
+		return
+	}
+	renderUploadPage(w, token, nil)
+}
+
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	dir := getWebUploadDir()
+	if dir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
+	if ok, reason := AccessAllowed(r.RemoteAddr); !ok {
+		LogWarn("Blocked web upload:"+reason, FPeer(r.RemoteAddr))
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if !CheckPairingToken(token) {
+		LogWarn("Reject web upload:pairing token mismatch", FPeer(r.RemoteAddr))
+		http.Error(w, "pairing token required", http.StatusForbidden)
+		return
+	}
+	//浏览器上传不知道单个文件的大小，有请求的总大小时先整体检查剩余空间，之后按实际读取的字节数计入本次接收总量
+	body := &uploadBody{ReadCloser: newIdleBody(w, r.Body), dir: dir}
+	if r.ContentLength > 0 {
+		if reason := ReserveReceive(dir, 0, r.ContentLength); reason != "" {
+			LogWarn("Reject web upload:"+reason, FPeer(address), FBytes(r.ContentLength))
+			http.Error(w, reason, http.StatusRequestEntityTooLarge)
+			return
+		}
+		body.reserved = r.ContentLength
+	}
+	defer body.finish()
+	r.Body = body
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results := make([]string, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			LogErr("Web upload error:"+err.Error(), FPeer(address))
+			results = append(results, "Error: "+err.Error())
+			break
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		startTime := time.Now()
+		result, err := ReceiveUpload(dir, part, address, r.ContentLength)
+		RecordTransfer(DirectionReceived, address, result, startTime, err)
+		NotifyTransfer(DirectionReceived, address, result, err)
+		part.Close()
+		if err != nil {
+			LogErr("Web upload error:"+err.Error(), FPeer(address), FFile(result.Name))
+			results = append(results, result.Name+": "+err.Error())
+			break
+		}
+		RunReceiveHooks(result, "Browser", address)
+		results = append(results, result.Name+": "+OutcomeSuccess+" "+FormatByteSize(result.Size, 1))
+	}
+	renderUploadPage(w, token, results)
+}
+
+// uploadReserveStep 分块上传时每次预留的字节数，减少检查剩余空间的次数
+const uploadReserveStep = 1 << 20
+
+// uploadBody 统计浏览器上传实际读取的字节数，超出已预留的部分时按uploadReserveStep继续检查限制与剩余空间
+type uploadBody struct {
+	io.ReadCloser
+	dir      string
+	reserved int64
+	read     int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.reserved {
+		need := b.read - b.reserved + uploadReserveStep
+		if reason := ReserveReceive(b.dir, 0, need); reason != "" {
+			return n, errors.New(reason)
+		}
+		b.reserved += need
+	}
+	return n, err
+}
+
+// finish 上传结束，退还预留但没有读取的字节数
+func (b *uploadBody) finish() {
+	FinishReceive(b.reserved, b.reserved-b.read)
+}
+
+// ReceiveUpload 按与ReceiveFile相同的保存路径与同名文件策略保存浏览器上传的文件
+func ReceiveUpload(dir string, part *multipart.Part, address string, contentLength int64) (FileResult, error) {
+	startTime := time.Now()
+	result := FileResult{Name: part.FileName()}
+	dir, err := RouteDir(dir, part.FileName(), "Browser")
+	if err != nil {
+		LogWarn("Route received file error:"+err.Error(), FFile(result.Name))
+	}
+	newFile, fPath, err := CreateSaveFile(dir, part.FileName())
+	if err != nil {
+		return result, errors.Join(errors.New("error creating file"), err)
+	}
+	defer newFile.Close()
+	//浏览器上传不知道单个文件的大小，用请求的总大小估算进度，分块上传时没有总大小
+	transfer := NewTransfer(NewTransferId(), DirectionReceived, address, "Browser", nil)
+	defer transfer.Done()
+	if contentLength <= 0 {
+		contentLength = -1
+	}
+	transfer.SetFile(result.Name, contentLength)
+	hash := md5.New()
+	multiWriter := io.MultiWriter(newFile, hash, transfer)
+	var reader io.Reader = part
+	if Setting.ReceiveFileLimit > 0 {
+		reader = io.LimitReader(part, Setting.ReceiveFileLimit+1)
+	}
+	n, err := io.CopyBuffer(multiWriter, NewRateLimitedReader(reader, transfer), make([]byte, 1<<17))
+	result.Size = n
+	if err == nil && Setting.ReceiveFileLimit > 0 && n > Setting.ReceiveFileLimit {
+		err = errors.New(RejectTooLarge)
+	}
+	if err != nil {
+		newFile.Close()
+		errF := os.Remove(fPath)
+		return result, errors.Join(errors.New("error reading file"), errF, err)
+	}
+	result.Path = fPath
+	result.MD5 = hex.EncodeToString(hash.Sum(nil))
+	Log("Received web upload", FPeer(address), FFile(result.Name), FBytes(n), F("totalTime", time.Now().Sub(startTime).String()), F("md5", result.MD5))
+	return result, nil
+}
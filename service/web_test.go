@@ -0,0 +1,58 @@
+package service
+
+import (
+	"fyne.io/fyne/v2/test"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHandleUploadChunked 分块上传没有ContentLength，ipv6地址的发送端按ip记录
+func TestHandleUploadChunked(t *testing.T) {
+	if MainApp == nil {
+		MainApp = test.NewApp()
+	}
+	dir := t.TempDir()
+	savedConfig, savedDir, savedHistory, savedIdle := ConfigPath, webUploadDir, History, Setting.IdleTimeout
+	defer func() {
+		ConfigPath, webUploadDir, History, Setting.IdleTimeout = savedConfig, savedDir, savedHistory, savedIdle
+	}()
+	//ResponseRecorder不支持设置读取超时
+	Setting.IdleTimeout = 0
+	ConfigPath = filepath.Join(dir, "config.json")
+	webUploadDir = filepath.Join(dir, "upload")
+	os.MkdirAll(webUploadDir, 0755)
+	History = nil
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, _ := form.CreateFormFile("file", "note.txt")
+		part.Write([]byte("hello from a phone"))
+		form.Close()
+		pw.Close()
+	}()
+	r := httptest.NewRequest(http.MethodPost, "/upload?token="+Setting.PairingToken, pr)
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.RemoteAddr = "[fe80::1%eth0]:53000"
+	w := httptest.NewRecorder()
+	handleUpload(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	got, err := os.ReadFile(filepath.Join(webUploadDir, "note.txt"))
+	if err != nil || string(got) != "hello from a phone" {
+		t.Fatalf("uploaded file %q %v", got, err)
+	}
+	if len(History) != 1 || History[0].Peer != "fe80::1%eth0" || History[0].Outcome != OutcomeSuccess {
+		t.Fatalf("history %+v", History)
+	}
+	if ip, ok := SenderIP(History[0].Peer); !ok || ip != "fe80::1" {
+		t.Errorf("sender ip %q %v", ip, ok)
+	}
+}